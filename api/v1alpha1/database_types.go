@@ -36,16 +36,211 @@ type DatabaseSpec struct {
 
 	// LabelSelector define which node to authorize on the specified service
 	LabelSelector *metav1.LabelSelector `json:"labelSelector,omitempty"`
+
+	// CredentialsSecretRef references a Secret, in the namespace of the Database, holding the OVHcloud api
+	// credentials. If not set, the credentials of the operator are used.
+	CredentialsSecretRef *CredentialsSecretRef `json:"credentialsSecretRef,omitempty"`
+
+	// IpFamilies are the address families of the IPs to authorize, IPv4 only by default
+	IpFamilies []IpFamily `json:"ipFamilies,omitempty"`
+
+	// EgressDiscovery configures how the egress IPs of the cluster are discovered for public services,
+	// it overrides the defaults of the operator
+	EgressDiscovery *EgressDiscovery `json:"egressDiscovery,omitempty"`
+
+	// DryRun computes the changes of the ip restrictions of the services and reports them in the status
+	// and events, without applying them
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// SafetyGuards block the changes that would remove too many IPs from the services,
+	// they override the defaults of the operator
+	SafetyGuards *SafetyGuards `json:"safetyGuards,omitempty"`
+}
+
+// SafetyGuards block the sync of the services when the selected nodes look wrong, until the
+// cloud.ovh.net/override-safety-guards annotation is set on the Database
+type SafetyGuards struct {
+	// MinNodes is the minimum number of selected nodes, 0 disables the guard
+	//+kubebuilder:validation:Minimum=0
+	MinNodes *int32 `json:"minNodes,omitempty"`
+
+	// MaxRemovalPercent is the maximum percentage of the IPs authorized by the operator on a service
+	// that may be removed at once, 0 disables the guard
+	//+kubebuilder:validation:Minimum=0
+	//+kubebuilder:validation:Maximum=100
+	MaxRemovalPercent *int32 `json:"maxRemovalPercent,omitempty"`
+}
+
+// CredentialsSecretRef references a Secret holding the applicationKey, applicationSecret, consumerKey
+// and region keys
+type CredentialsSecretRef struct {
+	// Name of the Secret
+	Name string `json:"name"`
+
+	// Region of the OVHcloud api, either ovh-eu, ovh-ca or ovh-us. It overrides the region key of the Secret.
+	Region string `json:"region,omitempty"`
+}
+
+//+kubebuilder:validation:Enum=IPv4;IPv6
+
+// IpFamily is an IP address family
+type IpFamily string
+
+const (
+	IPv4 IpFamily = "IPv4"
+	IPv6 IpFamily = "IPv6"
+)
+
+// Egress discovery modes
+const (
+	// EgressDiscoveryEcho requests an echo service that answers with the caller public IP
+	EgressDiscoveryEcho = "Echo"
+	// EgressDiscoveryStatic uses a fixed list of egress IPs
+	EgressDiscoveryStatic = "Static"
+	// EgressDiscoveryProbe runs a probe pod requesting the echo service on each group of selected nodes
+	EgressDiscoveryProbe = "Probe"
+	// EgressDiscoveryAnnotation reads the egress IPs from an annotation on a Service or on the selected nodes
+	EgressDiscoveryAnnotation = "Annotation"
+	// EgressDiscoveryDisabled only authorizes the IPs of the nodes
+	EgressDiscoveryDisabled = "Disabled"
+)
+
+// EgressDiscovery defines how the egress IPs of the cluster are discovered
+type EgressDiscovery struct {
+	// Mode is the discovery strategy, one of Echo, Probe, Static, Annotation or Disabled
+	//+kubebuilder:validation:Enum=Echo;Probe;Static;Annotation;Disabled
+	Mode string `json:"mode,omitempty"`
+
+	// EchoURL is the URL requested in Echo and Probe modes, it must answer with the caller IP in plain text
+	//+kubebuilder:validation:Pattern=`^https?://`
+	EchoURL string `json:"echoUrl,omitempty"`
+
+	// StaticIps is the list of egress IPs used in Static mode
+	StaticIps []string `json:"staticIps,omitempty"`
+
+	// Annotation is the annotation holding a comma separated list of egress IPs in Annotation mode
+	Annotation string `json:"annotation,omitempty"`
+
+	// ServiceName is the Service, in the namespace of the Database, holding the annotation.
+	// If not set, the annotation is read on the selected nodes.
+	ServiceName string `json:"serviceName,omitempty"`
+
+	// Timeout of the discovery
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
 }
 
+// Condition types reported in the DatabaseStatus
+const (
+	// ConditionReady is true when all the targeted services are up to date
+	ConditionReady = "Ready"
+	// ConditionOvhApiReachable is false when the last call to the OVHcloud api failed
+	ConditionOvhApiReachable = "OvhApiReachable"
+	// ConditionSynced is true when the ip restrictions were pushed on all the targeted services
+	ConditionSynced = "Synced"
+	// ConditionCredentialsValid is false when the credentials lack the access rules needed on the project, or expired
+	ConditionCredentialsValid = "CredentialsValid"
+	// ConditionBlocked is true when a safety guard blocks the sync of the services
+	ConditionBlocked = "Blocked"
+	// ConditionApplied is true when the ip restrictions of the Database are active on all the targeted services
+	ConditionApplied = "Applied"
+)
+
 // DatabaseStatus defines the observed state of Database
 type DatabaseStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
+
+	// ObservedGeneration is the last generation of the spec processed by the operator
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions represent the latest available observations of the Database state
+	//+listType=map
+	//+listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// Services is the list of services on which the IPs are authorized
+	Services []ServiceStatus `json:"services,omitempty"`
+
+	// LastSyncTime is the last time the IPs were successfully synchronized on all the services
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+
+	// Egress is the result of the last egress IPs discovery
+	Egress *EgressStatus `json:"egress,omitempty"`
+}
+
+// EgressStatus defines the observed egress of the cluster
+type EgressStatus struct {
+	// Mode used to discover the egress IPs
+	Mode string `json:"mode"`
+
+	// Ips is the list of discovered egress IPs
+	Ips []string `json:"ips,omitempty"`
+
+	// Gateway is true when the egress IPs are not the ones of the nodes, in which case only them are authorized,
+	// along with the IPs of the nodes of the groups egressing with their own IPs in Probe mode
+	Gateway bool `json:"gateway,omitempty"`
+
+	// Groups are the egress IPs found by the probe of each group of nodes, in Probe mode only
+	Groups []EgressGroup `json:"groups,omitempty"`
+}
+
+// EgressGroup is the egress IP found by the probe of a group of nodes
+type EgressGroup struct {
+	// Name of the group, the values of the group labels of its nodes
+	Name string `json:"name"`
+
+	// Ip is the egress IP of the nodes of the group
+	Ip string `json:"ip"`
+
+	// Gateway is true when the egress IP is not one of the nodes
+	Gateway bool `json:"gateway,omitempty"`
+}
+
+// ServiceStatus defines the observed state of a public cloud database service
+type ServiceStatus struct {
+	// ServiceId of the public cloud database service
+	ServiceId string `json:"serviceId"`
+
+	// Engine of the service as returned by the OVHcloud api
+	Engine string `json:"engine,omitempty"`
+
+	// NetworkType of the service, either public or private
+	NetworkType string `json:"networkType,omitempty"`
+
+	// AuthorizedIps is the list of IPs authorized on the service by the operator for this Database
+	AuthorizedIps []string `json:"authorizedIps,omitempty"`
+
+	// PlannedAdditions is the list of IPs that would be authorized on the service, in dry run only
+	PlannedAdditions []string `json:"plannedAdditions,omitempty"`
+
+	// PlannedRemovals is the list of IPs that would be removed from the service, in dry run only
+	PlannedRemovals []string `json:"plannedRemovals,omitempty"`
+
+	// IpStates is the state of each of the AuthorizedIps on the service
+	//+listType=map
+	//+listMapKey=ip
+	IpStates []IpState `json:"ipStates,omitempty"`
+
+	// LastChangeTime is the last time the operator changed the ip restrictions of the service for this Database
+	LastChangeTime *metav1.Time `json:"lastChangeTime,omitempty"`
+}
+
+// IpState defines the state of an IP authorized on a service
+type IpState struct {
+	// Ip authorized on the service
+	Ip string `json:"ip"`
+
+	// State of the ip restriction as reported by the OVHcloud api, READY once active
+	State string `json:"state"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Project",type=string,JSONPath=`.spec.projectId`
+//+kubebuilder:printcolumn:name="Service",type=string,JSONPath=`.spec.serviceId`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Last Sync",type=date,JSONPath=`.status.lastSyncTime`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // Database is the Schema for the databases API
 type Database struct {
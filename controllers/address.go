@@ -0,0 +1,62 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/ovh/public-cloud-databases-operator/api/v1alpha1"
+)
+
+// ipFamilies returns the address families authorized by the crd, IPv4 only by default
+func ipFamilies(crd v1alpha1.Database) []v1alpha1.IpFamily {
+	if len(crd.Spec.IpFamilies) == 0 {
+		return []v1alpha1.IpFamily{v1alpha1.IPv4}
+	}
+	return crd.Spec.IpFamilies
+}
+
+// AddressFamily returns the family of a valid address
+func AddressFamily(addr netip.Addr) v1alpha1.IpFamily {
+	if addr.Is4() {
+		return v1alpha1.IPv4
+	}
+	return v1alpha1.IPv6
+}
+
+// AddressPrefix returns the prefix matching only the address, /32 for IPv4 and /128 for IPv6.
+// An empty prefix is returned if the family of the address is not part of the families.
+func AddressPrefix(address string, families []v1alpha1.IpFamily) (string, error) {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return "", fmt.Errorf("invalid address %q: %w", address, err)
+	}
+	// IPv4-mapped IPv6 addresses are authorized as IPv4
+	addr = addr.Unmap()
+	if addr.Zone() != "" {
+		return "", fmt.Errorf("invalid address %q: zoned addresses are not supported", address)
+	}
+
+	family := AddressFamily(addr)
+	for _, f := range families {
+		if f == family {
+			return netip.PrefixFrom(addr, addr.BitLen()).String(), nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	"github.com/ovh/public-cloud-databases-operator/api/v1alpha1"
+)
+
+func TestAddressPrefix(t *testing.T) {
+	dualStack := []v1alpha1.IpFamily{v1alpha1.IPv4, v1alpha1.IPv6}
+	tests := []struct {
+		address  string
+		families []v1alpha1.IpFamily
+		want     string
+		wantErr  bool
+	}{
+		{address: "10.0.0.1", families: dualStack, want: "10.0.0.1/32"},
+		{address: "2001:db8::1", families: dualStack, want: "2001:db8::1/128"},
+		{address: "::ffff:10.0.0.1", families: dualStack, want: "10.0.0.1/32"},
+		{address: "2001:db8::1", families: []v1alpha1.IpFamily{v1alpha1.IPv4}, want: ""},
+		{address: "10.0.0.1", families: []v1alpha1.IpFamily{v1alpha1.IPv6}, want: ""},
+		{address: "fe80::1%eth0", families: dualStack, wantErr: true},
+		{address: "10.0.0.1/24", families: dualStack, wantErr: true},
+		{address: "node-1", families: dualStack, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := AddressPrefix(tt.address, tt.families)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("AddressPrefix(%q) error = %v, wantErr %v", tt.address, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("AddressPrefix(%q) = %q, want %q", tt.address, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/ovh/public-cloud-databases-operator/api/v1alpha1"
+)
+
+const (
+	// DefaultApplyTimeout is the delay after a change of the ip restrictions from which they are reported as not applied
+	DefaultApplyTimeout = 10 * time.Minute
+	// appliedPollInterval is the delay between two reads of the services while the ip restrictions are being applied
+	appliedPollInterval = 10 * time.Second
+
+	// IpStateReady is the state of an ip restriction active on the service
+	IpStateReady = "READY"
+	// IpStatePending is the state of an ip restriction just written by the operator, until read again
+	IpStatePending = "PENDING"
+	// IpStateAbsent is the state of an ip restriction not yet written on the service, in dry run
+	IpStateAbsent = "ABSENT"
+)
+
+// Reasons of the Applied condition
+const (
+	reasonApplied      = "Applied"
+	reasonApplying     = "Applying"
+	reasonApplyTimeout = "ApplyTimeout"
+)
+
+// concurrentChangeError is returned when the entries not managed by the operator changed while the
+// service was being updated, the update is aborted instead of overwriting them
+type concurrentChangeError struct {
+	serviceId string
+	diff      IpRestrictionsDiff
+}
+
+func (e *concurrentChangeError) Error() string {
+	return fmt.Sprintf("service %s: ip restrictions changed concurrently (%s), update aborted", e.serviceId, e.diff)
+}
+
+// ipRestrictionCalls are the calls to the per entry routes applying a diff
+type ipRestrictionCalls struct {
+	add    []IpRestriction
+	update []IpRestriction
+	delete []IpRestriction
+}
+
+// changesOf splits the diff in entries to add, delete, and update when only their description changes
+func changesOf(diff IpRestrictionsDiff) ipRestrictionCalls {
+	removed := make(map[string]struct{}, len(diff.Removed))
+	for _, ip := range diff.Removed {
+		removed[ip.IP] = struct{}{}
+	}
+	changes := ipRestrictionCalls{}
+	updated := map[string]struct{}{}
+	for _, ip := range diff.Added {
+		if _, ok := removed[ip.IP]; ok {
+			changes.update = append(changes.update, ip)
+			updated[ip.IP] = struct{}{}
+			continue
+		}
+		changes.add = append(changes.add, ip)
+	}
+	for _, ip := range diff.Removed {
+		if _, ok := updated[ip.IP]; !ok {
+			changes.delete = append(changes.delete, ip)
+		}
+	}
+	return changes
+}
+
+// applyIpRestrictions applies the diff to the service entry by entry, so that the entries changed meanwhile
+// by someone else are never overwritten. The new entries are added before the old ones are deleted, and the
+// entries whose description changes are updated in place, so that no ip loses its access in between.
+// The whole list is replaced by newIPs only when the per entry routes can not be used for the service.
+func applyIpRestrictions(ctx context.Context, ovhApi OvhApi, owners *serviceOwners, projectId string, serviceId string, cluster *Cluster, diff IpRestrictionsDiff, newIPs []IpRestriction) error {
+	err := applyIpRestrictionChanges(ctx, ovhApi, projectId, serviceId, cluster.Engine, changesOf(diff))
+	if !IsUnsupported(err) {
+		return err
+	}
+	log.FromContext(ctx).Info("per entry ip restriction routes not available, replacing the whole list", "reason", err.Error())
+	return replaceIpRestrictions(ctx, ovhApi, owners, projectId, serviceId, cluster, newIPs)
+}
+
+// replaceIpRestrictions replaces the whole list of the service. newIPs is built from a previous read of the
+// service, which is read again right before the update: the update is aborted if the entries not managed by
+// the operator changed in between, as they would be overwritten.
+func replaceIpRestrictions(ctx context.Context, ovhApi OvhApi, owners *serviceOwners, projectId string, serviceId string, cluster *Cluster, newIPs []IpRestriction) error {
+	latest, err := ovhApi.GetCluster(ctx, projectId, serviceId)
+	if err != nil {
+		return &ovhCallError{op: "get service", err: err}
+	}
+	if changed := DiffIpRestrictions(owners.unmanaged(cluster.Ips), owners.unmanaged(latest.Ips)); !changed.IsEmpty() {
+		observeIpRestrictionConflict(projectId, serviceId)
+		return &concurrentChangeError{serviceId: serviceId, diff: changed}
+	}
+	if err := ovhApi.UpdateClusterNodeIps(ctx, projectId, serviceId, cluster.Engine, newIPs); err != nil {
+		return &ovhCallError{op: "update service ip restrictions", err: err}
+	}
+	return nil
+}
+
+func applyIpRestrictionChanges(ctx context.Context, ovhApi OvhApi, projectId string, serviceId string, engine string, changes ipRestrictionCalls) error {
+	for _, ip := range changes.add {
+		if err := ovhApi.AddIpRestriction(ctx, projectId, serviceId, engine, ip); err != nil {
+			return &ovhCallError{op: "add service ip restriction " + ip.IP, err: err}
+		}
+	}
+	for _, ip := range changes.update {
+		if err := ovhApi.UpdateIpRestriction(ctx, projectId, serviceId, engine, ip); err != nil {
+			return &ovhCallError{op: "update service ip restriction " + ip.IP, err: err}
+		}
+	}
+	for _, ip := range changes.delete {
+		err := ovhApi.DeleteIpRestriction(ctx, projectId, serviceId, engine, ip.IP)
+		if IsNotFound(err) {
+			// already deleted by someone else
+			continue
+		}
+		if err != nil {
+			return &ovhCallError{op: "delete service ip restriction " + ip.IP, err: err}
+		}
+	}
+	return nil
+}
+
+// ipStates returns the state of the desired ips on the service. The ips just written are pending until the service
+// is read again, the ones whose status is not reported by the api are considered active.
+func ipStates(cluster *Cluster, desired []IpRestriction, written []IpRestriction) []v1alpha1.IpState {
+	pending := make(map[string]struct{}, len(written))
+	for _, ip := range written {
+		pending[ip.IP] = struct{}{}
+	}
+	present := make(map[string]struct{}, len(cluster.Ips))
+	for _, ip := range cluster.Ips {
+		present[ip.IP] = struct{}{}
+	}
+
+	states := make([]v1alpha1.IpState, 0, len(desired))
+	seen := make(map[string]struct{}, len(desired))
+	for _, ip := range desired {
+		if _, ok := seen[ip.IP]; ok {
+			continue
+		}
+		seen[ip.IP] = struct{}{}
+		state := IpStateReady
+		if _, ok := pending[ip.IP]; ok {
+			state = IpStatePending
+		} else if _, ok := present[ip.IP]; !ok {
+			state = IpStateAbsent
+		} else if status := cluster.IpStatus[ip.IP]; status != "" {
+			state = status
+		}
+		states = append(states, v1alpha1.IpState{Ip: ip.IP, State: state})
+	}
+	return states
+}
+
+// lastChangeTime returns the last time the ip restrictions of the service were changed for the crd
+func lastChangeTime(crd v1alpha1.Database, serviceId string) *metav1.Time {
+	for _, service := range crd.Status.Services {
+		if service.ServiceId == serviceId {
+			return service.LastChangeTime
+		}
+	}
+	return nil
+}
+
+func (r *DatabaseReconciler) applyTimeout() time.Duration {
+	if r.ApplyTimeout == 0 {
+		return DefaultApplyTimeout
+	}
+	return r.ApplyTimeout
+}
+
+// setAppliedCondition reports if the ip restrictions of the crd are active on all its services. They are
+// waited for until the apply timeout elapsed since the last change, then reported as timed out.
+func (r *DatabaseReconciler) setAppliedCondition(crd *v1alpha1.Database, now time.Time) {
+	pending := []string{}
+	var lastChange time.Time
+	for _, service := range crd.Status.Services {
+		for _, ip := range service.IpStates {
+			if ip.State != IpStateReady {
+				pending = append(pending, fmt.Sprintf("%s on %s is %s", ip.Ip, service.ServiceId, ip.State))
+			}
+		}
+		if service.LastChangeTime != nil && service.LastChangeTime.After(lastChange) {
+			lastChange = service.LastChangeTime.Time
+		}
+	}
+	if len(pending) == 0 {
+		setCondition(crd, v1alpha1.ConditionApplied, metav1.ConditionTrue, reasonApplied, "ip restrictions are active on all the services")
+		return
+	}
+
+	// without change from the operator, the ips are waited for since they are reported pending
+	previous := meta.FindStatusCondition(crd.Status.Conditions, v1alpha1.ConditionApplied)
+	since := lastChange
+	if since.IsZero() {
+		since = now
+		if previous != nil && previous.Status == metav1.ConditionFalse {
+			since = previous.LastTransitionTime.Time
+		}
+	}
+	if now.Sub(since) < r.applyTimeout() {
+		setCondition(crd, v1alpha1.ConditionApplied, metav1.ConditionFalse, reasonApplying, strings.Join(pending, ", "))
+		return
+	}
+	message := fmt.Sprintf("not active %s after the last change: %s", r.applyTimeout(), strings.Join(pending, ", "))
+	if previous == nil || previous.Reason != reasonApplyTimeout {
+		r.Recorder.Event(crd, corev1.EventTypeWarning, eventReasonApplyTimeout, message)
+	}
+	setCondition(crd, v1alpha1.ConditionApplied, metav1.ConditionFalse, reasonApplyTimeout, message)
+}
+
+// applying checks if the ip restrictions of the crd are being applied, the services are then polled
+func applying(crd v1alpha1.Database) bool {
+	applied := meta.FindStatusCondition(crd.Status.Conditions, v1alpha1.ConditionApplied)
+	return applied != nil && applied.Reason == reasonApplying
+}
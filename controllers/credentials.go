@@ -0,0 +1,234 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ovh/go-ovh/ovh"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/ovh/public-cloud-databases-operator/api/v1alpha1"
+)
+
+// Keys of the credentials Secrets, the same as the ones of the secret created by the helm chart
+const (
+	SecretKeyRegion            = "region"
+	SecretKeyApplicationKey    = "applicationKey"
+	SecretKeyApplicationSecret = "applicationSecret"
+	SecretKeyConsumerKey       = "consumerKey"
+	SecretKeyClientId          = "clientId"
+	SecretKeyClientSecret      = "clientSecret"
+)
+
+// Authentication modes of the OVHcloud api clients
+const (
+	AuthModeApplication = "application"
+	AuthModeOAuth2      = "oauth2"
+)
+
+// OvhCredentials are the credentials used to call the OVHcloud api, either the application
+// key, secret and consumer key, or the client id and secret of an IAM service account
+type OvhCredentials struct {
+	Region            string
+	ApplicationKey    string
+	ApplicationSecret string
+	ConsumerKey       string
+	ClientId          string
+	ClientSecret      string
+}
+
+// AuthMode returns the authentication mode of the credentials
+func (c OvhCredentials) AuthMode() string {
+	if c.ClientId != "" || c.ClientSecret != "" {
+		return AuthModeOAuth2
+	}
+	return AuthModeApplication
+}
+
+// NewOvhApi builds an OvhApi client from the credentials
+func NewOvhApi(credentials OvhCredentials) (OvhApi, error) {
+	var client *ovh.Client
+	var err error
+	switch credentials.AuthMode() {
+	case AuthModeOAuth2:
+		// mixing both kinds of credentials is rejected by the client
+		if credentials.ApplicationKey != "" || credentials.ApplicationSecret != "" || credentials.ConsumerKey != "" {
+			return nil, errors.New("both application and oauth2 credentials are set")
+		}
+		client, err = ovh.NewOAuth2Client(credentials.Region, credentials.ClientId, credentials.ClientSecret)
+	default:
+		client, err = ovh.NewClient(
+			credentials.Region,
+			credentials.ApplicationKey,
+			credentials.ApplicationSecret,
+			credentials.ConsumerKey,
+		)
+	}
+	if err != nil {
+		return nil, err
+	}
+	api := NewOvhClient(client)
+	api.AuthMode = credentials.AuthMode()
+	return api, nil
+}
+
+// credentialsFinalizer is set on the credentials Secrets referenced by the Databases not yet released
+const credentialsFinalizer = "cloud.ovh.net/credentials"
+
+// credentialsError is returned when the credentials referenced by the crd can not be used
+type credentialsError struct {
+	err error
+}
+
+func (e *credentialsError) Error() string {
+	return fmt.Sprintf("invalid credentials: %v", e.err)
+}
+
+func (e *credentialsError) Unwrap() error {
+	return e.err
+}
+
+// ovhClientCache holds the clients built from the credentials Secrets, along with the
+// resource version of the Secret they were built from
+type ovhClientCache struct {
+	mu      sync.Mutex
+	clients map[types.NamespacedName]cachedOvhClient
+}
+
+type cachedOvhClient struct {
+	resourceVersion string
+	api             OvhApi
+}
+
+func (c *ovhClientCache) get(key types.NamespacedName) (cachedOvhClient, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	client, ok := c.clients[key]
+	return client, ok
+}
+
+func (c *ovhClientCache) set(key types.NamespacedName, client cachedOvhClient) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.clients == nil {
+		c.clients = map[types.NamespacedName]cachedOvhClient{}
+	}
+	c.clients[key] = client
+}
+
+// ovhClientFor returns the client of the crd: the one built from its credentials Secret if any,
+// the default one of the operator otherwise
+func (r *DatabaseReconciler) ovhClientFor(ctx context.Context, crd v1alpha1.Database) (OvhApi, error) {
+	ref := crd.Spec.CredentialsSecretRef
+	if ref == nil {
+		return r.OvhClient, nil
+	}
+
+	logger := log.FromContext(ctx)
+	key := types.NamespacedName{Namespace: crd.Namespace, Name: ref.Name}
+	cached, found := r.ovhClients.get(key)
+
+	// the secrets are not cached, only their metadata is watched
+	secret := corev1.Secret{}
+	if err := r.apiReader().Get(ctx, key, &secret); err != nil {
+		// the secret may be deleted along with the crd, keep using the last known client to revoke its ips
+		if apierrors.IsNotFound(err) && found && !crd.DeletionTimestamp.IsZero() {
+			return cached.api, nil
+		}
+		return nil, &credentialsError{err: err}
+	}
+	if found && cached.resourceVersion == secret.ResourceVersion {
+		return cached.api, nil
+	}
+
+	credentials := OvhCredentials{
+		Region:            string(secret.Data[SecretKeyRegion]),
+		ApplicationKey:    string(secret.Data[SecretKeyApplicationKey]),
+		ApplicationSecret: string(secret.Data[SecretKeyApplicationSecret]),
+		ConsumerKey:       string(secret.Data[SecretKeyConsumerKey]),
+		ClientId:          string(secret.Data[SecretKeyClientId]),
+		ClientSecret:      string(secret.Data[SecretKeyClientSecret]),
+	}
+	if ref.Region != "" {
+		credentials.Region = ref.Region
+	}
+
+	newOvhApi := r.NewOvhApi
+	if newOvhApi == nil {
+		newOvhApi = NewOvhApi
+	}
+	api, err := newOvhApi(credentials)
+	if err != nil {
+		return nil, &credentialsError{err: fmt.Errorf("secret %s: %w", key, err)}
+	}
+	logger.Info(fmt.Sprintf("built ovh api client from secret %s", key), "authMode", credentials.AuthMode())
+	setAuthModeMetric(key.String(), credentials.AuthMode())
+	r.ovhClients.set(key, cachedOvhClient{resourceVersion: secret.ResourceVersion, api: api})
+	return api, nil
+}
+
+// syncCredentialsFinalizers keeps the finalizer of the credentials Secrets of the namespace while they are referenced
+// by a Database not yet released, the released one excluded. The Secrets deleted along with their namespace are then
+// kept until the ips of the Databases using them are revoked.
+func (r *DatabaseReconciler) syncCredentialsFinalizers(ctx context.Context, namespace string, released types.UID) error {
+	databases := v1alpha1.DatabaseList{}
+	if err := r.List(ctx, &databases, client.InNamespace(namespace)); err != nil {
+		return fmt.Errorf("failed to list databases: %w", err)
+	}
+	referenced := map[string]struct{}{}
+	for i := range databases.Items {
+		crd := &databases.Items[i]
+		if crd.UID != released && crd.Spec.CredentialsSecretRef != nil && controllerutil.ContainsFinalizer(crd, databaseFinalizer) {
+			referenced[crd.Spec.CredentialsSecretRef.Name] = struct{}{}
+		}
+	}
+
+	secrets := metav1.PartialObjectMetadataList{}
+	secrets.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("SecretList"))
+	if err := r.List(ctx, &secrets, client.InNamespace(namespace)); err != nil {
+		return fmt.Errorf("failed to list secrets: %w", err)
+	}
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		_, used := referenced[secret.Name]
+		// no finalizer can be added to a secret being deleted
+		if used == controllerutil.ContainsFinalizer(secret, credentialsFinalizer) || (used && !secret.DeletionTimestamp.IsZero()) {
+			continue
+		}
+		secret.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Secret"))
+		patch := client.MergeFromWithOptions(secret.DeepCopy(), client.MergeFromWithOptimisticLock{})
+		if used {
+			controllerutil.AddFinalizer(secret, credentialsFinalizer)
+		} else {
+			controllerutil.RemoveFinalizer(secret, credentialsFinalizer)
+		}
+		if err := r.Patch(ctx, secret, patch); client.IgnoreNotFound(err) != nil {
+			return fmt.Errorf("failed to update the finalizers of secret %s: %w", secret.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,357 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/ovh/public-cloud-databases-operator/api/v1alpha1"
+)
+
+const (
+	DefaultCredentialsCheckInterval     = time.Hour
+	DefaultCredentialsExpirationWarning = 7 * 24 * time.Hour
+
+	// CredentialStatusValidated is the status of a credential usable to call the api
+	CredentialStatusValidated = "validated"
+)
+
+// Reasons of the CredentialsValid condition
+const (
+	reasonCredentialsValid       = "CredentialsValid"
+	reasonCredentialsExpiresSoon = "CredentialsExpiresSoon"
+	reasonCredentialsExpired     = "CredentialsExpired"
+	reasonCredentialsNotValid    = "CredentialsNotValidated"
+	reasonMissingAccessRules     = "MissingAccessRules"
+	reasonCredentialsCheckFailed = "CredentialsCheckFailed"
+)
+
+// CredentialsCheckConfig is the configuration of the check of the access rules of the credentials
+type CredentialsCheckConfig struct {
+	// Interval is the delay before the credential is fetched again from the api
+	Interval time.Duration
+	// ExpirationWarning is the delay before the expiration of the credential from which it is reported
+	ExpirationWarning time.Duration
+}
+
+func (c CredentialsCheckConfig) withDefaults() CredentialsCheckConfig {
+	if c.Interval == 0 {
+		c.Interval = DefaultCredentialsCheckInterval
+	}
+	if c.ExpirationWarning == 0 {
+		c.ExpirationWarning = DefaultCredentialsExpirationWarning
+	}
+	return c
+}
+
+// Route is a call to the ovh api made by the operator
+type Route struct {
+	Method string
+	Path   string
+}
+
+func (r Route) String() string {
+	return r.Method + " " + r.Path
+}
+
+// RequiredRoutes returns the routes called by the operator on the project and its known services
+func RequiredRoutes(projectId string, services []v1alpha1.ServiceStatus) []Route {
+	routes := []Route{{Method: http.MethodGet, Path: fmt.Sprintf("%s/%s/%s", PrefixEndpoint, projectId, GetServiceEndpoint)}}
+	for _, service := range services {
+		routes = append(routes,
+			Route{Method: http.MethodGet, Path: fmt.Sprintf("%s/%s/%s/%s", PrefixEndpoint, projectId, GetServiceEndpoint, service.ServiceId)},
+			Route{Method: http.MethodPut, Path: fmt.Sprintf("%s/%s/database/%s/%s", PrefixEndpoint, projectId, service.Engine, service.ServiceId)},
+		)
+	}
+	return routes
+}
+
+// Allows checks if the rule grants the route, a * in the path of the rule matches any characters
+func (rule AccessRule) Allows(route Route) bool {
+	return rule.Method == route.Method && matchWildcard(rule.Path, route.Path)
+}
+
+// MissingRoutes returns the routes granted by none of the rules of the credential
+func (c Credential) MissingRoutes(routes []Route) []Route {
+	missing := []Route{}
+	for _, route := range routes {
+		allowed := false
+		for _, rule := range c.Rules {
+			if rule.Allows(route) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			missing = append(missing, route)
+		}
+	}
+	return missing
+}
+
+// checkCredential returns the status, reason and message of the CredentialsValid condition
+func checkCredential(credential Credential, routes []Route, expirationWarning time.Duration, now time.Time) (metav1.ConditionStatus, string, string) {
+	if credential.Status != CredentialStatusValidated {
+		return metav1.ConditionFalse, reasonCredentialsNotValid, fmt.Sprintf("credential %d is %s", credential.CredentialId, credential.Status)
+	}
+	if credential.Expiration != nil && !credential.Expiration.After(now) {
+		return metav1.ConditionFalse, reasonCredentialsExpired, fmt.Sprintf("credential %d expired at %s", credential.CredentialId, credential.Expiration.Format(time.RFC3339))
+	}
+	if missing := credential.MissingRoutes(routes); len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for _, route := range missing {
+			names = append(names, route.String())
+		}
+		return metav1.ConditionFalse, reasonMissingAccessRules, fmt.Sprintf("credential %d is missing the access rules: %s", credential.CredentialId, strings.Join(names, ", "))
+	}
+	if credential.Expiration != nil && credential.Expiration.Sub(now) < expirationWarning {
+		return metav1.ConditionTrue, reasonCredentialsExpiresSoon, fmt.Sprintf("credential %d expires at %s", credential.CredentialId, credential.Expiration.Format(time.RFC3339))
+	}
+	return metav1.ConditionTrue, reasonCredentialsValid, ""
+}
+
+// matchWildcard matches the value against the pattern, in which * matches any characters
+func matchWildcard(pattern string, value string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == value
+	}
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		index := strings.Index(value, part)
+		if index < 0 {
+			return false
+		}
+		value = value[index+len(part):]
+	}
+	return strings.HasSuffix(value, parts[len(parts)-1])
+}
+
+// credentialCache holds the credential of each client, or the error of its lookup, fetched at most once per check interval
+type credentialCache struct {
+	mu          sync.Mutex
+	credentials map[OvhApi]cachedCredential
+}
+
+type cachedCredential struct {
+	credential Credential
+	err        error
+	expires    time.Time
+}
+
+func (c *credentialCache) get(api OvhApi) (cachedCredential, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.credentials[api]
+	if !ok || time.Now().After(cached.expires) {
+		return cachedCredential{}, false
+	}
+	return cached, true
+}
+
+func (c *credentialCache) set(api OvhApi, credential Credential, err error, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.credentials == nil {
+		c.credentials = map[OvhApi]cachedCredential{}
+	}
+	c.credentials[api] = cachedCredential{credential: credential, err: err, expires: time.Now().Add(ttl)}
+}
+
+// currentCredential returns the credential of the client, from the cache if fetched recently. A failed
+// lookup is not retried before the next check either.
+func (r *DatabaseReconciler) currentCredential(ctx context.Context, api OvhApi) (Credential, error) {
+	// the client of the operator can be swapped, the credential belongs to the current one
+	key := currentOvhApi(api)
+	if cached, ok := r.credentials.get(key); ok {
+		return cached.credential, cached.err
+	}
+	credential, err := api.GetCurrentCredential(ctx)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "failed to get the current credential")
+		r.credentials.set(key, Credential{}, err, r.CredentialsCheck.withDefaults().Interval)
+		return Credential{}, err
+	}
+	r.credentials.set(key, *credential, nil, r.CredentialsCheck.withDefaults().Interval)
+	return *credential, nil
+}
+
+// currentOvhApi returns the client currently used by a swappable client
+func currentOvhApi(api OvhApi) OvhApi {
+	if swappable, ok := api.(*SwappableOvhApi); ok {
+		return swappable.Load()
+	}
+	return api
+}
+
+// hasAccessRules checks if the access of the client is granted by the access rules of its consumer key,
+// the access of the oauth2 service accounts is granted by IAM policies instead
+func hasAccessRules(api OvhApi) bool {
+	client, ok := currentOvhApi(api).(*OvhClient)
+	return !ok || client.AuthMode != AuthModeOAuth2
+}
+
+// checkCredentials sets the CredentialsValid condition of the crd from the access rules of its credential
+func (r *DatabaseReconciler) checkCredentials(ctx context.Context, crd *v1alpha1.Database) {
+	logger := log.FromContext(ctx)
+	ovhApi, err := r.ovhClientFor(ctx, *crd)
+	if err != nil {
+		// already reported by the sync
+		return
+	}
+
+	if !hasAccessRules(ovhApi) {
+		meta.RemoveStatusCondition(&crd.Status.Conditions, v1alpha1.ConditionCredentialsValid)
+		return
+	}
+
+	credential, err := r.currentCredential(ctx, ovhApi)
+	if err != nil {
+		setCondition(crd, v1alpha1.ConditionCredentialsValid, metav1.ConditionUnknown, reasonCredentialsCheckFailed, err.Error())
+		return
+	}
+
+	routes := RequiredRoutes(crd.Spec.ProjectId, crd.Status.Services)
+	status, reason, message := checkCredential(credential, routes, r.CredentialsCheck.withDefaults().ExpirationWarning, time.Now())
+	previous := meta.FindStatusCondition(crd.Status.Conditions, v1alpha1.ConditionCredentialsValid)
+	if reason != reasonCredentialsValid && (previous == nil || previous.Reason != reason) {
+		logger.Info(message)
+		r.Recorder.Event(crd, corev1.EventTypeWarning, reason, message)
+	}
+	setCondition(crd, v1alpha1.ConditionCredentialsValid, status, reason, message)
+}
+
+// CredentialsChecker checks the access rules of the credentials of the operator against the routes
+// needed by the Databases using them, at startup and then periodically. It backs a readiness check.
+type CredentialsChecker struct {
+	Api        OvhApi
+	Reconciler *DatabaseReconciler
+
+	mu      sync.Mutex
+	checked bool
+	err     error
+}
+
+// NewCredentialsChecker builds the checker of the credentials of the operator
+func NewCredentialsChecker(api OvhApi, r *DatabaseReconciler) *CredentialsChecker {
+	return &CredentialsChecker{Api: api, Reconciler: r}
+}
+
+// NeedLeaderElection returns false, the readiness of all the replicas depends on the check
+func (c *CredentialsChecker) NeedLeaderElection() bool {
+	return false
+}
+
+// Start checks the credentials until the context is done
+func (c *CredentialsChecker) Start(ctx context.Context) error {
+	ticker := time.NewTicker(c.Reconciler.CredentialsCheck.withDefaults().Interval)
+	defer ticker.Stop()
+	for {
+		c.check(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check is the readiness check, failing when the credentials are not usable by the operator
+func (c *CredentialsChecker) Check(_ *http.Request) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.checked {
+		return errors.New("credentials not checked yet")
+	}
+	return c.err
+}
+
+func (c *CredentialsChecker) check(ctx context.Context) {
+	logger := ctrl.Log.WithName("credentials")
+	config := c.Reconciler.CredentialsCheck.withDefaults()
+	if !hasAccessRules(c.Api) {
+		logger.V(1).Info("the access of the oauth2 service account is granted by IAM policies, not checked")
+		c.setResult(nil)
+		return
+	}
+
+	credential, err := c.Api.GetCurrentCredential(ctx)
+	if err != nil {
+		// the credential can not be verified, the calls made by the reconciles will tell
+		logger.Error(err, "failed to get the current credential")
+		c.setResult(nil)
+		return
+	}
+
+	databases := v1alpha1.DatabaseList{}
+	if err := c.Reconciler.List(ctx, &databases); err != nil {
+		logger.Error(err, "failed to list the databases")
+		return
+	}
+	projects := map[string][]v1alpha1.ServiceStatus{}
+	for _, crd := range databases.Items {
+		// the databases with a credentials reference are checked by their reconcile
+		if crd.Spec.CredentialsSecretRef == nil {
+			projects[crd.Spec.ProjectId] = append(projects[crd.Spec.ProjectId], crd.Status.Services...)
+		}
+	}
+	routes := []Route{}
+	projectIds := make([]string, 0, len(projects))
+	for projectId := range projects {
+		projectIds = append(projectIds, projectId)
+	}
+	sort.Strings(projectIds)
+	for _, projectId := range projectIds {
+		routes = append(routes, RequiredRoutes(projectId, projects[projectId])...)
+	}
+
+	status, reason, message := checkCredential(*credential, routes, config.ExpirationWarning, time.Now())
+	switch {
+	case status == metav1.ConditionFalse:
+		logger.Error(errors.New(message), "the credentials of the operator can not be used", "reason", reason)
+		c.setResult(errors.New(message))
+	case reason == reasonCredentialsExpiresSoon:
+		logger.Info(message, "reason", reason)
+		c.setResult(nil)
+	default:
+		logger.V(1).Info("the credentials of the operator are valid", "routes", len(routes))
+		c.setResult(nil)
+	}
+}
+
+func (c *CredentialsChecker) setResult(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checked = true
+	c.err = err
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ovh/go-ovh/ovh"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/ovh/public-cloud-databases-operator/api/v1alpha1"
+)
+
+func TestCheckCredential(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	soon := now.Add(24 * time.Hour)
+	past := now.Add(-time.Hour)
+	routes := []Route{
+		{Method: http.MethodGet, Path: "/cloud/project/p/database/service"},
+		{Method: http.MethodPut, Path: "/cloud/project/p/database/mysql/s"},
+	}
+	all := []AccessRule{{Method: http.MethodGet, Path: "/*"}, {Method: http.MethodPut, Path: "/cloud/project/p/database/*"}}
+
+	tests := []struct {
+		name       string
+		credential Credential
+		status     metav1.ConditionStatus
+		reason     string
+	}{
+		{"valid", Credential{Status: CredentialStatusValidated, Rules: all}, metav1.ConditionTrue, reasonCredentialsValid},
+		{"expires soon", Credential{Status: CredentialStatusValidated, Rules: all, Expiration: &soon}, metav1.ConditionTrue, reasonCredentialsExpiresSoon},
+		{"expired", Credential{Status: CredentialStatusValidated, Rules: all, Expiration: &past}, metav1.ConditionFalse, reasonCredentialsExpired},
+		{"not validated", Credential{Status: "pendingValidation", Rules: all}, metav1.ConditionFalse, reasonCredentialsNotValid},
+		{"missing rule", Credential{Status: CredentialStatusValidated, Rules: all[:1]}, metav1.ConditionFalse, reasonMissingAccessRules},
+		{"other project", Credential{Status: CredentialStatusValidated, Rules: []AccessRule{
+			{Method: http.MethodGet, Path: "/cloud/project/other/*"},
+			{Method: http.MethodPut, Path: "/cloud/project/p/database/*"},
+		}}, metav1.ConditionFalse, reasonMissingAccessRules},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, reason, message := checkCredential(tt.credential, routes, 7*24*time.Hour, now)
+			if status != tt.status || reason != tt.reason {
+				t.Errorf("checkCredential() = %s, %s (%s), want %s, %s", status, reason, message, tt.status, tt.reason)
+			}
+		})
+	}
+}
+
+func TestCheckCredentialsSkipsOAuth2Clients(t *testing.T) {
+	database := newTestDatabase(nil)
+	r, ovhApi := newTestReconciler(t, database)
+	ovhApi.InjectError(FakeGetCurrentCredential, &ovh.APIError{Code: http.StatusForbidden, Message: "forbidden"})
+
+	// a failed lookup is cached until the next check
+	for i := 0; i < 2; i++ {
+		r.checkCredentials(context.Background(), database)
+	}
+	if calls := ovhApi.Calls(FakeGetCurrentCredential); calls != 1 {
+		t.Errorf("expected a single lookup, got %d", calls)
+	}
+	condition := meta.FindStatusCondition(database.Status.Conditions, v1alpha1.ConditionCredentialsValid)
+	if condition == nil || condition.Reason != reasonCredentialsCheckFailed {
+		t.Errorf("unexpected CredentialsValid condition: %+v", condition)
+	}
+
+	// the oauth2 service accounts have no access rules
+	oauth2, err := NewOvhApi(OvhCredentials{Region: "ovh-eu", ClientId: "id", ClientSecret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.OvhClient = NewSwappableOvhApi(oauth2)
+	r.checkCredentials(context.Background(), database)
+	if condition := meta.FindStatusCondition(database.Status.Conditions, v1alpha1.ConditionCredentialsValid); condition != nil {
+		t.Errorf("expected no CredentialsValid condition, got %+v", condition)
+	}
+	checker := NewCredentialsChecker(r.OvhClient, r)
+	checker.check(context.Background())
+	if err := checker.Check(nil); err != nil {
+		t.Errorf("expected the check to pass, got %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+)
+
+func TestNewOvhApiAuthMode(t *testing.T) {
+	tests := []struct {
+		name        string
+		credentials OvhCredentials
+		mode        string
+		wantErr     bool
+	}{
+		{
+			name:        "application",
+			credentials: OvhCredentials{Region: "ovh-eu", ApplicationKey: "key", ApplicationSecret: "secret", ConsumerKey: "consumer"},
+			mode:        AuthModeApplication,
+		},
+		{
+			name:        "oauth2",
+			credentials: OvhCredentials{Region: "ovh-eu", ClientId: "id", ClientSecret: "secret"},
+			mode:        AuthModeOAuth2,
+		},
+		{
+			name:        "oauth2 without secret",
+			credentials: OvhCredentials{Region: "ovh-eu", ClientId: "id"},
+			mode:        AuthModeOAuth2,
+			wantErr:     true,
+		},
+		{
+			name:        "both",
+			credentials: OvhCredentials{Region: "ovh-eu", ApplicationKey: "key", ApplicationSecret: "secret", ClientId: "id", ClientSecret: "secret"},
+			mode:        AuthModeOAuth2,
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if mode := tt.credentials.AuthMode(); mode != tt.mode {
+				t.Errorf("AuthMode() = %s, want %s", mode, tt.mode)
+			}
+			api, err := NewOvhApi(tt.credentials)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewOvhApi() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			client := api.(*OvhClient).Client
+			if tt.mode == AuthModeOAuth2 && client.ClientID != tt.credentials.ClientId {
+				t.Errorf("expected an oauth2 client, got %+v", client)
+			}
+			if tt.mode == AuthModeApplication && client.AppKey != tt.credentials.ApplicationKey {
+				t.Errorf("expected an application client, got %+v", client)
+			}
+		})
+	}
+}
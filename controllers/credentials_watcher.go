@@ -0,0 +1,188 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/ovh/public-cloud-databases-operator/api/v1alpha1"
+)
+
+const DefaultCredentialsPollInterval = 30 * time.Second
+
+// SwappableOvhApi is an OvhApi whose client can be replaced at runtime, the calls
+// in progress keep using the client they started with
+type SwappableOvhApi struct {
+	api atomic.Pointer[OvhApi]
+}
+
+var _ OvhApi = &SwappableOvhApi{}
+
+func NewSwappableOvhApi(api OvhApi) *SwappableOvhApi {
+	s := &SwappableOvhApi{}
+	s.Swap(api)
+	return s
+}
+
+// Swap replaces the client
+func (s *SwappableOvhApi) Swap(api OvhApi) {
+	s.api.Store(&api)
+}
+
+// Load returns the current client
+func (s *SwappableOvhApi) Load() OvhApi {
+	return *s.api.Load()
+}
+
+func (s *SwappableOvhApi) GetServicesForProjectId(ctx context.Context, projectId string) ([]string, error) {
+	return s.Load().GetServicesForProjectId(ctx, projectId)
+}
+
+func (s *SwappableOvhApi) GetCluster(ctx context.Context, projectId string, serviceId string) (*Cluster, error) {
+	return s.Load().GetCluster(ctx, projectId, serviceId)
+}
+
+func (s *SwappableOvhApi) UpdateClusterNodeIps(ctx context.Context, projectId string, serviceId string, engine string, ips []IpRestriction) error {
+	return s.Load().UpdateClusterNodeIps(ctx, projectId, serviceId, engine, ips)
+}
+
+func (s *SwappableOvhApi) AddIpRestriction(ctx context.Context, projectId string, serviceId string, engine string, ip IpRestriction) error {
+	return s.Load().AddIpRestriction(ctx, projectId, serviceId, engine, ip)
+}
+
+func (s *SwappableOvhApi) UpdateIpRestriction(ctx context.Context, projectId string, serviceId string, engine string, ip IpRestriction) error {
+	return s.Load().UpdateIpRestriction(ctx, projectId, serviceId, engine, ip)
+}
+
+func (s *SwappableOvhApi) DeleteIpRestriction(ctx context.Context, projectId string, serviceId string, engine string, ip string) error {
+	return s.Load().DeleteIpRestriction(ctx, projectId, serviceId, engine, ip)
+}
+
+func (s *SwappableOvhApi) GetCurrentCredential(ctx context.Context) (*Credential, error) {
+	return s.Load().GetCurrentCredential(ctx)
+}
+
+// LoadCredentialsDir reads the credentials from a directory holding one file per key of the
+// credentials Secret, as done when the Secret is mounted as a volume
+func LoadCredentialsDir(dir string) (OvhCredentials, error) {
+	read := func(key string) (string, error) {
+		value, err := os.ReadFile(filepath.Join(dir, key))
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil
+		}
+		return strings.TrimSpace(string(value)), err
+	}
+
+	credentials := OvhCredentials{}
+	var err error
+	if credentials.Region, err = read(SecretKeyRegion); err != nil {
+		return credentials, err
+	}
+	if credentials.ApplicationKey, err = read(SecretKeyApplicationKey); err != nil {
+		return credentials, err
+	}
+	if credentials.ApplicationSecret, err = read(SecretKeyApplicationSecret); err != nil {
+		return credentials, err
+	}
+	if credentials.ConsumerKey, err = read(SecretKeyConsumerKey); err != nil {
+		return credentials, err
+	}
+	if credentials.ClientId, err = read(SecretKeyClientId); err != nil {
+		return credentials, err
+	}
+	if credentials.ClientSecret, err = read(SecretKeyClientSecret); err != nil {
+		return credentials, err
+	}
+	return credentials, nil
+}
+
+// CredentialsWatcher polls the credentials directory, and swaps the client of the operator
+// when the credentials change. The Databases are then requeued to use the new client.
+type CredentialsWatcher struct {
+	Dir        string
+	Interval   time.Duration
+	Api        *SwappableOvhApi
+	Reconciler *DatabaseReconciler
+
+	current OvhCredentials
+}
+
+// NewCredentialsWatcher builds the watcher from the credentials currently used by the client
+func NewCredentialsWatcher(dir string, interval time.Duration, api *SwappableOvhApi, current OvhCredentials, r *DatabaseReconciler) *CredentialsWatcher {
+	return &CredentialsWatcher{Dir: dir, Interval: interval, Api: api, Reconciler: r, current: current}
+}
+
+// NeedLeaderElection returns false, all the replicas must use the up to date credentials
+func (w *CredentialsWatcher) NeedLeaderElection() bool {
+	return false
+}
+
+// Start polls the credentials until the context is done
+func (w *CredentialsWatcher) Start(ctx context.Context) error {
+	logger := ctrl.Log.WithName("credentials")
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		credentials, err := LoadCredentialsDir(w.Dir)
+		if err != nil {
+			logger.Error(err, "failed to read credentials")
+			continue
+		}
+		if credentials == w.current {
+			continue
+		}
+
+		api, err := w.newOvhApi()(credentials)
+		if err != nil {
+			// keep the previous client until the credentials are fixed
+			logger.Error(err, "failed to build ovh api client from the new credentials")
+			continue
+		}
+		w.Api.Swap(api)
+		w.current = credentials
+		logger.Info("ovh api credentials reloaded", "authMode", credentials.AuthMode())
+		SetOperatorAuthModeMetric(credentials.AuthMode())
+
+		// only the databases without credentials reference use the client of the operator
+		usesDefault := func(crd v1alpha1.Database) bool { return crd.Spec.CredentialsSecretRef == nil }
+		if err := w.Reconciler.RequeueAll(ctx, usesDefault); err != nil {
+			logger.Error(err, "failed to requeue the databases")
+		}
+	}
+}
+
+func (w *CredentialsWatcher) newOvhApi() func(OvhCredentials) (OvhApi, error) {
+	if w.Reconciler.NewOvhApi != nil {
+		return w.Reconciler.NewOvhApi
+	}
+	return NewOvhApi
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func TestCredentialsWatcherSwapsClient(t *testing.T) {
+	dir := t.TempDir()
+	write := func(key string, value string) {
+		if err := os.WriteFile(filepath.Join(dir, key), []byte(value), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(SecretKeyRegion, "ovh-eu")
+	write(SecretKeyConsumerKey, "old")
+
+	credentials, err := LoadCredentialsDir(dir)
+	if err != nil || credentials.ConsumerKey != "old" {
+		t.Fatalf("unexpected credentials %+v, %v", credentials, err)
+	}
+
+	oldApi, newApi := NewFakeOvhApi(), NewFakeOvhApi()
+	api := NewSwappableOvhApi(oldApi)
+	built := make(chan OvhCredentials, 1)
+	r := &DatabaseReconciler{NewOvhApi: func(credentials OvhCredentials) (OvhApi, error) {
+		built <- credentials
+		return newApi, nil
+	}}
+	// on a follower, the requeued Databases are not read by any controller
+	r.requeue = make(chan event.GenericEvent)
+	r.elected = make(chan struct{})
+	watcher := NewCredentialsWatcher(dir, 10*time.Millisecond, api, credentials, r)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = watcher.Start(ctx) }()
+
+	write(SecretKeyConsumerKey, "new\n")
+	select {
+	case got := <-built:
+		if got.ConsumerKey != "new" || got.Region != "ovh-eu" {
+			t.Errorf("unexpected credentials %+v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("credentials were not reloaded")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for api.Load() != OvhApi(newApi) {
+		if time.Now().After(deadline) {
+			t.Fatal("client was not swapped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the next rotations are still seen
+	write(SecretKeyConsumerKey, "newer")
+	select {
+	case got := <-built:
+		if got.ConsumerKey != "newer" {
+			t.Errorf("unexpected credentials %+v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("credentials were not reloaded again")
+	}
+}
@@ -18,35 +18,82 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
 	"strings"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
-	"github.com/ovh/go-ovh/ovh"
 	"github.com/ovh/public-cloud-databases-operator/api/v1alpha1"
 )
 
 // DatabaseReconciler reconciles a Database object
 type DatabaseReconciler struct {
 	client.Client
-	Scheme    *runtime.Scheme
-	OvhClient *ovh.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// APIReader reads the credentials Secrets and the Services holding the egress IPs, which are not cached, the Client by default
+	APIReader client.Reader
+
+	// OvhClient is the client of the Databases without credentials reference
+	OvhClient OvhApi
+	// NewOvhApi builds the clients of the Databases referencing credentials, NewOvhApi by default
+	NewOvhApi func(credentials OvhCredentials) (OvhApi, error)
+
+	// EgressDiscovery is the default egress IPs discovery of the Databases
+	EgressDiscovery EgressDiscoveryConfig
+	// CredentialsCheck is the configuration of the check of the access rules of the credentials
+	CredentialsCheck CredentialsCheckConfig
+	// ClusterName identifies the cluster in the descriptions of the ip restrictions, so that the operators
+	// of several clusters sharing a service only manage their own entries
+	ClusterName string
+	// SafetyGuards is the default configuration of the safety guards of the Databases
+	SafetyGuards SafetyGuardsConfig
+	// DryRun only reports the changes of the ip restrictions of all the Databases, without applying them
+	DryRun bool
+	// ApplyTimeout is the delay after a change of the ip restrictions from which they are reported as not applied, DefaultApplyTimeout by default
+	ApplyTimeout time.Duration
+	// NodeTaints is the configuration of the taint of the nodes not yet authorized, not managed by default
+	NodeTaints NodeTaintsConfig
+	// ResyncInterval is the delay between two syncs of a Database without change, DefaultResyncInterval by default
+	ResyncInterval time.Duration
+
+	egressProbes egressProbeCache
+	backoff      requeueBackoff
+	ovhClients   ovhClientCache
+	credentials  credentialCache
+	// requeue receives the Databases to reconcile outside of the watches
+	requeue chan event.GenericEvent
+	// elected is closed once the replica is the leader, and runs the controller reading requeue
+	elected <-chan struct{}
 }
 
 //+kubebuilder:rbac:groups=cloud.ovh.net,resources=databases,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=cloud.ovh.net,resources=databases/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=cloud.ovh.net,resources=databases/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch;patch
+//+kubebuilder:rbac:groups="",resources=services,verbs=get
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;patch
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;create;delete
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -57,112 +104,452 @@ func (r *DatabaseReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 	logger := ctrl.Log.WithName("controllers").WithName("Service").WithValues("req", req)
 	logger.V(1).Info("reconcile")
 
-	//v1alpha1.SchemeBuilder.
-	serviceList := &v1alpha1.DatabaseList{}
-	err := r.List(ctx, serviceList)
-	if err != nil {
-		logger.Error(err, "failed to list crd")
+	crd := v1alpha1.Database{}
+	if err := r.Get(ctx, req.NamespacedName, &crd); err != nil {
+		if apierrors.IsNotFound(err) {
+			logger.V(1).Info("crd not found, ignoring")
+			return ctrl.Result{}, nil
+		}
+		logger.Error(err, "failed to get crd")
 		return ctrl.Result{}, err
 	}
-	for _, crd := range serviceList.Items {
-		logger.V(1).Info(fmt.Sprintf("spec: %v", crd.Spec))
-		logger := logger.WithValues("project_id", crd.Spec.ProjectId)
-		opts := []client.ListOption{}
-		if crd.Spec.LabelSelector != nil {
-			logger.V(1).Info(fmt.Sprintf("match labels: %v", crd.Spec.LabelSelector.MatchLabels))
-			for k, v := range crd.Spec.LabelSelector.MatchLabels {
-				opts = append(opts, client.MatchingLabels{k: v})
+	logger.V(1).Info(fmt.Sprintf("spec: %v", crd.Spec))
+	logger = logger.WithValues("project_id", crd.Spec.ProjectId)
+
+	// the crd is being deleted, revoke its ips before releasing it
+	if !crd.DeletionTimestamp.IsZero() {
+		if controllerutil.ContainsFinalizer(&crd, databaseFinalizer) {
+			err := r.RevokeServicesIpRestriction(log.IntoContext(ctx, logger), crd)
+			if credentialsErr := (&credentialsError{}); errors.As(err, &credentialsErr) && apierrors.IsNotFound(err) && neverSynced(crd) {
+				// the missing credentials never authorized any ip, there is nothing to revoke
+				logger.Info(fmt.Sprintf("%v, no ip to revoke", err))
+				err = nil
+			}
+			if err != nil {
+				logger.Error(err, "failed to revoke ip restrictions")
+				if callErr := (&ovhCallError{}); errors.As(err, &callErr) {
+					r.Recorder.Event(&crd, corev1.EventTypeWarning, eventReasonApiError, err.Error())
+				}
+				setSyncConditions(&crd, fmt.Errorf("failed to revoke ip restrictions: %w", err))
+				if err := r.Status().Update(ctx, &crd); err != nil {
+					logger.Error(err, "failed to update status")
+				}
+				// the crd can not be released until the ips are revoked, keep retrying with a backoff
+				return ctrl.Result{RequeueAfter: r.backoff.next(req.NamespacedName)}, nil
+			}
+			r.backoff.reset(req.NamespacedName)
+			// the nodes may no longer wait for any Database
+			if err := r.syncNodeTaints(log.IntoContext(ctx, logger), crd); err != nil {
+				logger.Error(err, "failed to sync node taints")
+				return ctrl.Result{}, err
+			}
+			// the credentials are no longer needed to revoke the ips of the crd
+			if err := r.syncCredentialsFinalizers(ctx, crd.Namespace, crd.UID); err != nil {
+				logger.Error(err, "failed to release credentials")
+				return ctrl.Result{}, err
+			}
+			deleteDatabaseMetrics(crd)
+			controllerutil.RemoveFinalizer(&crd, databaseFinalizer)
+			if err := r.Update(ctx, &crd); err != nil {
+				logger.Error(err, "failed to remove finalizer")
+				return ctrl.Result{}, err
 			}
 		}
+		return ctrl.Result{}, nil
+	}
 
-		nodes := corev1.NodeList{}
-		logger.V(1).Info(fmt.Sprintf("opts: %v", opts))
-		err = r.List(ctx, &nodes, opts...)
-		if err != nil {
-			logger.Error(err, "failed to list nodes")
+	if !controllerutil.ContainsFinalizer(&crd, databaseFinalizer) {
+		controllerutil.AddFinalizer(&crd, databaseFinalizer)
+		if err := r.Update(ctx, &crd); err != nil {
+			logger.Error(err, "failed to add finalizer")
 			return ctrl.Result{}, err
 		}
-		logger.Info(fmt.Sprintf("nodes count: %d", len(nodes.Items)))
+	}
+	// the credentials must outlive the crd to revoke its ips
+	if err := r.syncCredentialsFinalizers(ctx, crd.Namespace, ""); err != nil {
+		logger.Error(err, "failed to sync credentials finalizers")
+		return ctrl.Result{}, err
+	}
 
-		var servicesIds []string
-		// check if there is a wildcard on service id, then process on all the services of the project
-		if crd.Spec.ServiceId == "" {
-			servicesIds, err = GetServicesForProjectId(ctx, r, crd.Spec.ProjectId)
-			if err != nil {
-				logger.Error(err, "failed to list services from project id")
-				return ctrl.Result{}, err
-			}
-		} else {
-			servicesIds = append(servicesIds, crd.Spec.ServiceId)
-		}
-		for _, serviceId := range servicesIds {
-			logger := logger.WithValues("service_id", serviceId)
-			logger.V(1).Info("processing")
-			if err := r.UpdateServiceIpRestriction(log.IntoContext(ctx, logger), crd, nodes, crd.Spec.ProjectId, serviceId); err != nil {
-				logger.Error(err, "failed to process ip restriction")
-				return ctrl.Result{}, err
+	if err := r.SyncDatabase(log.IntoContext(ctx, logger), &crd); err != nil {
+		if pendingErr := (&egressProbePendingError{}); errors.As(err, &pendingErr) {
+			logger.V(1).Info(err.Error())
+			return ctrl.Result{RequeueAfter: egressProbePollInterval}, nil
+		}
+		logger.Error(err, "failed to sync database")
+		if credentialsErr := (&credentialsError{}); errors.As(err, &credentialsErr) {
+			return ctrl.Result{RequeueAfter: r.backoff.next(req.NamespacedName)}, nil
+		}
+		if conflictErr := (&concurrentChangeError{}); errors.As(err, &conflictErr) {
+			// the next sync starts over from the latest ip restrictions
+			return ctrl.Result{RequeueAfter: r.backoff.next(req.NamespacedName)}, nil
+		}
+		if callErr := (&ovhCallError{}); errors.As(err, &callErr) {
+			if IsTransient(err) {
+				return ctrl.Result{RequeueAfter: r.backoff.next(req.NamespacedName)}, nil
 			}
-			logger.V(1).Info("done processing")
+			// retrying right away will not help, the error is reported in the status until the next sync
+			r.backoff.reset(req.NamespacedName)
+			return ctrl.Result{RequeueAfter: r.resyncInterval()}, nil
 		}
+		return ctrl.Result{}, err
 	}
+	r.backoff.reset(req.NamespacedName)
 
-	return ctrl.Result{}, nil
+	if err := r.syncNodeTaints(log.IntoContext(ctx, logger), crd); err != nil {
+		logger.Error(err, "failed to sync node taints")
+		return ctrl.Result{}, err
+	}
+	if applying(crd) {
+		// poll the services until the ip restrictions are active
+		return ctrl.Result{RequeueAfter: appliedPollInterval}, nil
+	}
+	// the services are synced again periodically, to correct the changes made outside of the operator
+	return ctrl.Result{RequeueAfter: r.resyncInterval()}, nil
 }
 
-func (r *DatabaseReconciler) UpdateServiceIpRestriction(ctx context.Context, crd v1alpha1.Database, nodes corev1.NodeList, projectId string, serviceId string) error {
+// neverSynced checks if the crd never authorized any ip
+func neverSynced(crd v1alpha1.Database) bool {
+	return crd.Status.LastSyncTime == nil && len(crd.Status.Services) == 0
+}
+
+func (r *DatabaseReconciler) apiReader() client.Reader {
+	if r.APIReader == nil {
+		return r.Client
+	}
+	return r.APIReader
+}
+
+func (r *DatabaseReconciler) resyncInterval() time.Duration {
+	if r.ResyncInterval == 0 {
+		return DefaultResyncInterval
+	}
+	return r.ResyncInterval
+}
+
+// SyncDatabase authorizes the selected nodes on all the services targeted by the crd and reports the result in its status
+func (r *DatabaseReconciler) SyncDatabase(ctx context.Context, crd *v1alpha1.Database) error {
 	logger := log.FromContext(ctx)
-	cluster, err := GetCluster(ctx, r, projectId, serviceId)
+	syncErr := r.syncServices(ctx, crd)
+	// nothing is written in dry run, the services are not synced
+	if syncErr == nil && !r.dryRun(*crd) {
+		now := metav1.Now()
+		crd.Status.LastSyncTime = &now
+		setDatabaseMetrics(*crd)
+	}
+	setSyncConditions(crd, syncErr)
+	if syncErr == nil {
+		r.setAppliedCondition(crd, time.Now())
+	}
+	if syncErr == nil && r.dryRun(*crd) {
+		setDryRunConditions(crd)
+	}
+	r.checkCredentials(ctx, crd)
+	crd.Status.ObservedGeneration = crd.Generation
+
+	guardErr := &safetyGuardError{}
+	conflictErr := &concurrentChangeError{}
+	if callErr := (&ovhCallError{}); errors.As(syncErr, &callErr) {
+		r.Recorder.Event(crd, corev1.EventTypeWarning, eventReasonApiError, syncErr.Error())
+	} else if errors.As(syncErr, &guardErr) {
+		r.Recorder.Event(crd, corev1.EventTypeWarning, eventReasonBlocked, syncErr.Error())
+	} else if errors.As(syncErr, &conflictErr) {
+		r.Recorder.Event(crd, corev1.EventTypeWarning, eventReasonConflict, syncErr.Error())
+	}
+
+	if err := r.Status().Update(ctx, crd); err != nil {
+		logger.Error(err, "failed to update status")
+		if syncErr == nil {
+			return err
+		}
+	}
+
+	if syncErr == nil && !r.dryRun(*crd) {
+		if err := r.clearSafetyGuardsOverride(ctx, crd); err != nil {
+			return err
+		}
+	}
+
+	// retrying will not help until the spec, the nodes or the annotations change, the error is only reported in the status
+	if selectorErr := (&invalidSelectorError{}); errors.As(syncErr, &selectorErr) || errors.As(syncErr, &guardErr) {
+		logger.Info(syncErr.Error())
+		return nil
+	}
+	return syncErr
+}
+
+func (r *DatabaseReconciler) syncServices(ctx context.Context, crd *v1alpha1.Database) error {
+	logger := log.FromContext(ctx)
+	selector, err := NodeSelector(*crd)
 	if err != nil {
 		return err
 	}
-	logger.V(1).Info(fmt.Sprintf("Old IPs: %+v", cluster.Ips))
+	logger.V(1).Info(fmt.Sprintf("node selector: %s", selector))
+
+	nodes := corev1.NodeList{}
+	if err := r.List(ctx, &nodes, client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return fmt.Errorf("failed to list nodes: %w", err)
+	}
+	logger.Info(fmt.Sprintf("nodes count: %d", len(nodes.Items)))
+	if err := r.safetyGuards(*crd).checkNodes(*crd, len(nodes.Items)); err != nil {
+		return err
+	}
 
-	newIPs, err := getKubeInternalAddress(ctx, nodes, crd)
+	ovhApi, err := r.ovhClientFor(ctx, *crd)
 	if err != nil {
 		return err
 	}
+	servicesIds, err := r.getServicesIds(ctx, ovhApi, *crd)
+	if err != nil {
+		return &ovhCallError{op: "list services from project id", err: err}
+	}
 
-	// if db is public get kube node public ip
-	if cluster.NetworkType == "public" {
-		newIPs, err = getKubePublicAddesses(ctx, nodes, crd, newIPs)
+	ips, err := newAuthorizedIps(ctx, r.ClusterName, *crd, nodes)
+	if err != nil {
+		return err
+	}
+	services := make([]v1alpha1.ServiceStatus, 0, len(servicesIds))
+	for _, serviceId := range servicesIds {
+		logger := logger.WithValues("service_id", serviceId)
+		logger.V(1).Info("processing")
+		service, err := r.UpdateServiceIpRestriction(log.IntoContext(ctx, logger), ovhApi, ips, crd.Spec.ProjectId, serviceId)
+		if crd.Spec.ServiceId == "" && IsNotFound(err) {
+			// the service was deleted since the services of the project were listed
+			logger.Info("service not found, skipped")
+			r.Recorder.Eventf(crd, corev1.EventTypeNormal, eventReasonServiceSkipped, "service %s: not found, skipped", serviceId)
+			continue
+		}
 		if err != nil {
 			return err
 		}
+		services = append(services, *service)
+		logger.V(1).Info("done processing")
+	}
+	r.recordEgressModeChange(crd, ips.egress)
+	crd.Status.Services = services
+	crd.Status.Egress = ips.egress
+	return nil
+}
+
+// dryRun checks if the changes of the crd must only be reported
+func (r *DatabaseReconciler) dryRun(crd v1alpha1.Database) bool {
+	return r.DryRun || crd.Spec.DryRun
+}
+
+// recordEgressModeChange records an event when the egress switches between the nodes and a gateway
+func (r *DatabaseReconciler) recordEgressModeChange(crd *v1alpha1.Database, egress *v1alpha1.EgressStatus) {
+	previous := crd.Status.Egress
+	if previous == nil || egress == nil || previous.Gateway == egress.Gateway {
+		return
+	}
+	if egress.Gateway {
+		r.Recorder.Eventf(crd, corev1.EventTypeNormal, eventReasonGatewayMode, "switched to gateway mode, egress ips [%s] are not node ips", strings.Join(egress.Ips, ", "))
+		return
+	}
+	r.Recorder.Event(crd, corev1.EventTypeNormal, eventReasonGatewayMode, "switched to per node mode, the nodes egress with their own ips")
+}
+
+// authorizedIps holds the ips to authorize for a crd. The public ones are only computed
+// when a public service is met, and then shared by all the services of the crd.
+type authorizedIps struct {
+	cluster  string
+	crd      v1alpha1.Database
+	nodes    corev1.NodeList
+	internal []IpRestriction
+	public   []IpRestriction
+	egress   *v1alpha1.EgressStatus
+}
+
+func newAuthorizedIps(ctx context.Context, cluster string, crd v1alpha1.Database, nodes corev1.NodeList) (*authorizedIps, error) {
+	internal, err := getKubeInternalAddress(ctx, cluster, nodes, crd)
+	if err != nil {
+		return nil, err
+	}
+	return &authorizedIps{cluster: cluster, crd: crd, nodes: nodes, internal: internal}, nil
+}
+
+// forNetwork returns the ips to authorize on a service of the given network type
+func (r *DatabaseReconciler) forNetwork(ctx context.Context, ips *authorizedIps, networkType string) ([]IpRestriction, error) {
+	if networkType != "public" {
+		return ips.internal, nil
 	}
 
-	for _, ip := range cluster.Ips {
-		if !strings.HasPrefix(ip.Description, ipRestrictionPrefix) {
-			newIPs = append(newIPs, ip)
+	// if db is public get kube node public ip
+	if ips.public == nil {
+		egress, err := r.discoverEgressIps(ctx, ips.crd, ips.nodes)
+		if pendingErr := (&egressProbePendingError{}); !errors.As(err, &pendingErr) {
+			config, _ := r.egressDiscovery(ips.crd)
+			observeEgressDiscovery(config.Mode, err)
+		}
+		if err != nil {
+			return nil, err
 		}
+		public, err := getKubePublicAddesses(ctx, ips.cluster, ips.nodes, ips.crd, ips.internal, egress)
+		if err != nil {
+			return nil, err
+		}
+		ips.public = public
+		ips.egress = egress
+	}
+	return ips.public, nil
+}
+
+// getServicesIds returns the services targeted by the crd
+func (r *DatabaseReconciler) getServicesIds(ctx context.Context, ovhApi OvhApi, crd v1alpha1.Database) ([]string, error) {
+	// check if there is a wildcard on service id, then process on all the services of the project
+	if crd.Spec.ServiceId == "" {
+		return ovhApi.GetServicesForProjectId(ctx, crd.Spec.ProjectId)
+	}
+	return []string{crd.Spec.ServiceId}, nil
+}
+
+func (r *DatabaseReconciler) UpdateServiceIpRestriction(ctx context.Context, ovhApi OvhApi, ips *authorizedIps, projectId string, serviceId string) (*v1alpha1.ServiceStatus, error) {
+	logger := log.FromContext(ctx)
+	cluster, err := ovhApi.GetCluster(ctx, projectId, serviceId)
+	if err != nil {
+		return nil, &ovhCallError{op: "get service", err: err}
 	}
+	logger.V(1).Info(fmt.Sprintf("Old IPs: %+v", cluster.Ips))
+
+	desiredIPs, err := r.forNetwork(ctx, ips, cluster.NetworkType)
+	if err != nil {
+		return nil, err
+	}
+	service := &v1alpha1.ServiceStatus{
+		ServiceId:      serviceId,
+		Engine:         cluster.Engine,
+		NetworkType:    cluster.NetworkType,
+		AuthorizedIps:  ipsOf(desiredIPs),
+		IpStates:       ipStates(cluster, desiredIPs, nil),
+		LastChangeTime: lastChangeTime(ips.crd, serviceId),
+	}
+
+	// the other Databases targeting the service keep their own entries
+	owners, err := r.serviceOwners(ctx, ips.crd, projectId, serviceId)
+	if err != nil {
+		return nil, err
+	}
+	newIPs := owners.merge(cluster.Ips, desiredIPs)
 
 	logger.V(1).Info(fmt.Sprintf("New IPs: %+v", newIPs))
-	return UpdateClusterNodeIps(ctx, r, projectId, serviceId, cluster.Engine, newIPs)
+	diff := DiffIpRestrictions(cluster.Ips, newIPs)
+	if diff.IsEmpty() {
+		logger.V(1).Info("ip restrictions are up to date")
+		return service, nil
+	}
+
+	if err := r.safetyGuards(ips.crd).checkRemovals(ips.crd, r.ClusterName, serviceId, cluster.Ips, diff); err != nil {
+		return nil, err
+	}
+	if r.dryRun(ips.crd) {
+		logger.Info(fmt.Sprintf("dry run, not updating ip restrictions: %s", diff))
+		service.PlannedAdditions = ipsOf(diff.Added)
+		service.PlannedRemovals = ipsOf(diff.Removed)
+		// only the ips already on the service are authorized, the planned ones are not
+		service.AuthorizedIps = []string{}
+		for _, ip := range service.IpStates {
+			if ip.State != IpStateAbsent {
+				service.AuthorizedIps = append(service.AuthorizedIps, ip.Ip)
+			}
+		}
+		r.Recorder.Eventf(&ips.crd, corev1.EventTypeNormal, eventReasonDryRun, "service %s: would have %s", serviceId, diff)
+		return service, nil
+	}
+
+	logger.Info(fmt.Sprintf("updating ip restrictions: %s", diff))
+	if err := applyIpRestrictions(ctx, ovhApi, owners, projectId, serviceId, cluster, diff, newIPs); err != nil {
+		return nil, err
+	}
+	observeIpRestrictionChanges(projectId, serviceId, diff)
+	now := metav1.Now()
+	service.LastChangeTime = &now
+	// the entries whose description changed were updated in place, only the new ones are pending
+	service.IpStates = ipStates(cluster, desiredIPs, changesOf(diff).add)
+	if len(diff.Added) > 0 {
+		r.Recorder.Eventf(&ips.crd, corev1.EventTypeNormal, eventReasonAdded, "service %s: added [%s]", serviceId, joinIps(diff.Added))
+	}
+	if len(diff.Removed) > 0 {
+		r.Recorder.Eventf(&ips.crd, corev1.EventTypeNormal, eventReasonRemoved, "service %s: removed [%s]", serviceId, joinIps(diff.Removed))
+	}
+	return service, nil
+}
+
+// RevokeServicesIpRestriction removes the ips authorized by the crd from all the services it targets
+func (r *DatabaseReconciler) RevokeServicesIpRestriction(ctx context.Context, crd v1alpha1.Database) error {
+	logger := log.FromContext(ctx)
+	ovhApi, err := r.ovhClientFor(ctx, crd)
+	if err != nil {
+		return err
+	}
+	servicesIds, err := r.getServicesIds(ctx, ovhApi, crd)
+	if IsNotFound(err) || (IsForbidden(err) && len(crd.Status.Services) == 0) {
+		// the project is already gone, or the crd never had access to its services, nothing left to revoke
+		logger.Info(fmt.Sprintf("project not accessible, nothing to revoke: %v", err))
+		r.Recorder.Eventf(&crd, corev1.EventTypeNormal, eventReasonServiceSkipped, "project %s: not accessible, nothing to revoke", crd.Spec.ProjectId)
+		return nil
+	}
+	if err != nil {
+		return &ovhCallError{op: "list services from project id", err: err}
+	}
+	for _, serviceId := range servicesIds {
+		logger := logger.WithValues("service_id", serviceId)
+		if err := r.RevokeServiceIpRestriction(log.IntoContext(ctx, logger), ovhApi, crd, crd.Spec.ProjectId, serviceId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *DatabaseReconciler) RevokeServiceIpRestriction(ctx context.Context, ovhApi OvhApi, crd v1alpha1.Database, projectId string, serviceId string) error {
+	logger := log.FromContext(ctx)
+	cluster, err := ovhApi.GetCluster(ctx, projectId, serviceId)
+	if IsNotFound(err) {
+		// the service is already gone, nothing left to revoke
+		logger.V(1).Info("service not found")
+		r.Recorder.Eventf(&crd, corev1.EventTypeNormal, eventReasonServiceSkipped, "service %s: not found, nothing to revoke", serviceId)
+		return nil
+	}
+	if err != nil {
+		return &ovhCallError{op: "get service", err: err}
+	}
+
+	// the ips still wanted by the other Databases targeting the service are kept
+	owners, err := r.serviceOwners(ctx, crd, projectId, serviceId)
+	if err != nil {
+		return err
+	}
+	newIPs := owners.revoke(cluster.Ips)
+	if len(newIPs) == len(cluster.Ips) {
+		logger.V(1).Info("no ip to revoke")
+		return nil
+	}
+
+	diff := DiffIpRestrictions(cluster.Ips, newIPs)
+	if r.dryRun(crd) {
+		logger.Info(fmt.Sprintf("dry run, not revoking ip restrictions: %s", diff))
+		r.Recorder.Eventf(&crd, corev1.EventTypeNormal, eventReasonDryRun, "service %s: would have revoked [%s]", serviceId, joinIps(diff.Removed))
+		return nil
+	}
+	logger.Info(fmt.Sprintf("revoking ip restrictions: %s", diff))
+	if err := applyIpRestrictions(ctx, ovhApi, owners, projectId, serviceId, cluster, diff, newIPs); err != nil {
+		return err
+	}
+	observeIpRestrictionChanges(projectId, serviceId, diff)
+	r.Recorder.Eventf(&crd, corev1.EventTypeNormal, eventReasonRevoked, "service %s: %s", serviceId, diff)
+	return nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *DatabaseReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.requeue = make(chan event.GenericEvent)
+	r.elected = mgr.Elected()
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&v1alpha1.Database{}).
-		Watches(&corev1.Node{}, handler.EnqueueRequestsFromMapFunc(func(ctx context.Context, object client.Object) []ctrl.Request {
-			databaseList := &v1alpha1.DatabaseList{}
-			if err := mgr.GetClient().List(ctx, databaseList); err != nil {
-				mgr.GetLogger().Error(err, "failed to list crd")
-				return nil
-			}
-
-			reqs := make([]ctrl.Request, 0, len(databaseList.Items))
-			for _, database := range databaseList.Items {
-				reqs = append(reqs, ctrl.Request{
-					NamespacedName: types.NamespacedName{
-						Namespace: database.GetNamespace(),
-						Name:      database.GetName(),
-					},
-				})
-			}
-
-			return reqs
-		})).
+		// status updates must not trigger a new reconcile, the annotations may override the safety guards
+		For(&v1alpha1.Database{}, builder.WithPredicates(predicate.Or(predicate.GenerationChangedPredicate{}, predicate.AnnotationChangedPredicate{}))).
+		Watches(&corev1.Node{}, handler.EnqueueRequestsFromMapFunc(r.databasesForNode), builder.WithPredicates(nodeChangedPredicate())).
+		// only the metadata of the secrets is cached, they are read from the api server
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.databasesForSecret), builder.OnlyMetadata).
+		WatchesRawSource(source.Channel(r.requeue, &handler.EnqueueRequestForObject{})).
 		WithEventFilter(predicate.Funcs{
 			GenericFunc: func(e event.GenericEvent) bool {
 				return false
@@ -171,14 +558,139 @@ func (r *DatabaseReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		Complete(r)
 }
 
-func getKubeInternalAddress(ctx context.Context, nodes corev1.NodeList, crd v1alpha1.Database) ([]IpRestriction, error) {
+// databasesForNode returns a request for each crd whose label selector matches the node
+func (r *DatabaseReconciler) databasesForNode(ctx context.Context, object client.Object) []ctrl.Request {
 	logger := log.FromContext(ctx)
+	databaseList := &v1alpha1.DatabaseList{}
+	if err := r.List(ctx, databaseList); err != nil {
+		logger.Error(err, "failed to list crd")
+		return nil
+	}
+
+	nodeLabels := labels.Set(object.GetLabels())
+	reqs := make([]ctrl.Request, 0, len(databaseList.Items))
+	for _, database := range databaseList.Items {
+		selector, err := NodeSelector(database)
+		if err != nil || !selector.Matches(nodeLabels) {
+			continue
+		}
+		reqs = append(reqs, ctrl.Request{
+			NamespacedName: types.NamespacedName{
+				Namespace: database.GetNamespace(),
+				Name:      database.GetName(),
+			},
+		})
+	}
+
+	return reqs
+}
+
+// databasesForSecret returns a request for each crd using the secret as credentials
+func (r *DatabaseReconciler) databasesForSecret(ctx context.Context, object client.Object) []ctrl.Request {
+	logger := log.FromContext(ctx)
+	databaseList := &v1alpha1.DatabaseList{}
+	if err := r.List(ctx, databaseList, client.InNamespace(object.GetNamespace())); err != nil {
+		logger.Error(err, "failed to list crd")
+		return nil
+	}
+
+	reqs := []ctrl.Request{}
+	for _, database := range databaseList.Items {
+		ref := database.Spec.CredentialsSecretRef
+		if ref != nil && ref.Name == object.GetName() {
+			reqs = append(reqs, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(&database)})
+		}
+	}
+	return reqs
+}
+
+// RequeueAll enqueues the crds matching the filter, or all of them if the filter is nil. Nothing is enqueued
+// until the replica is the leader, which then reconciles all the crds anyway.
+func (r *DatabaseReconciler) RequeueAll(ctx context.Context, filter func(v1alpha1.Database) bool) error {
+	if r.requeue == nil {
+		return nil
+	}
+	select {
+	case <-r.elected:
+	default:
+		return nil
+	}
+	databaseList := &v1alpha1.DatabaseList{}
+	if err := r.List(ctx, databaseList); err != nil {
+		return err
+	}
+	for i := range databaseList.Items {
+		if filter != nil && !filter(databaseList.Items[i]) {
+			continue
+		}
+		select {
+		case r.requeue <- event.GenericEvent{Object: &databaseList.Items[i]}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// nodeChangedPredicate filters out the node updates that do not change its labels or addresses,
+// such as the status heartbeats
+func nodeChangedPredicate() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldNode, ok := e.ObjectOld.(*corev1.Node)
+			if !ok {
+				return true
+			}
+			newNode, ok := e.ObjectNew.(*corev1.Node)
+			if !ok {
+				return true
+			}
+			return !equality.Semantic.DeepEqual(oldNode.Labels, newNode.Labels) ||
+				!equality.Semantic.DeepEqual(oldNode.Status.Addresses, newNode.Status.Addresses)
+		},
+	}
+}
+
+// NodeSelector returns the selector of the nodes to authorize for the crd
+func NodeSelector(crd v1alpha1.Database) (labels.Selector, error) {
+	if crd.Spec.LabelSelector == nil {
+		return labels.Everything(), nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(crd.Spec.LabelSelector)
+	if err != nil {
+		return nil, &invalidSelectorError{err: err}
+	}
+	return selector, nil
+}
+
+// invalidSelectorError is returned when the label selector of the crd can not be converted
+type invalidSelectorError struct {
+	err error
+}
+
+func (e *invalidSelectorError) Error() string {
+	return fmt.Sprintf("invalid label selector: %v", e.err)
+}
+
+func (e *invalidSelectorError) Unwrap() error {
+	return e.err
+}
+
+func getKubeInternalAddress(ctx context.Context, cluster string, nodes corev1.NodeList, crd v1alpha1.Database) ([]IpRestriction, error) {
+	logger := log.FromContext(ctx)
+	families := ipFamilies(crd)
 	newIPs := make([]IpRestriction, 0)
 	for _, node := range nodes.Items {
 		for _, address := range node.Status.Addresses {
 			if address.Type == "InternalIP" {
-				ip := fmt.Sprintf("%s%s", address.Address, Mask)
-				newIPs = append(newIPs, IpRestriction{IP: ip, Description: IpRestrictionDescription(node, crd)})
+				ip, err := AddressPrefix(address.Address, families)
+				if err != nil {
+					logger.Error(err, "skipping node address", "node", node.Name)
+					continue
+				}
+				if ip != "" {
+					newIPs = append(newIPs, IpRestriction{IP: ip, Description: IpRestrictionDescription(cluster, node, crd)})
+				}
 			}
 		}
 	}
@@ -186,11 +698,13 @@ func getKubeInternalAddress(ctx context.Context, nodes corev1.NodeList, crd v1al
 	return newIPs, nil
 }
 
-func getKubePublicAddesses(ctx context.Context, nodes corev1.NodeList, crd v1alpha1.Database, newIPs []IpRestriction) ([]IpRestriction, error) {
+func getKubePublicAddesses(ctx context.Context, cluster string, nodes corev1.NodeList, crd v1alpha1.Database, internalIPs []IpRestriction, egress *v1alpha1.EgressStatus) ([]IpRestriction, error) {
 	logger := log.FromContext(ctx)
 
 	// build public ip list based on kubernetes nodes
+	families := ipFamilies(crd)
 	ipsMap := make(map[string]struct{})
+	newIPs := append([]IpRestriction{}, internalIPs...)
 
 	for _, ip := range newIPs {
 		ipsMap[ip.IP] = struct{}{}
@@ -199,46 +713,130 @@ func getKubePublicAddesses(ctx context.Context, nodes corev1.NodeList, crd v1alp
 	for _, node := range nodes.Items {
 		for _, address := range node.Status.Addresses {
 			if address.Type == "ExternalIP" {
-				ip := fmt.Sprintf("%s%s", address.Address, Mask)
-				ipsMap[ip] = struct{}{}
-				newIPs = append(newIPs, IpRestriction{IP: ip, Description: IpRestrictionDescription(node, crd)})
+				ip, err := AddressPrefix(address.Address, families)
+				if err != nil {
+					logger.Error(err, "skipping node address", "node", node.Name)
+					continue
+				}
+				if ip != "" {
+					ipsMap[ip] = struct{}{}
+					newIPs = append(newIPs, IpRestriction{IP: ip, Description: IpRestrictionDescription(cluster, node, crd)})
+				}
 			}
 		}
 	}
 	logger.V(1).Info(fmt.Sprintf("New IPs (External): %+v", newIPs))
 
-	// Get the egress ip used from the cluster (the operator is inside the cluster)
-	ifconfigURL := "https://ifconfig.io"
-	res, err := http.Get(ifconfigURL)
+	// check if the egress ips are the ones of the kubernetes nodes
+	gatewayIPs := []IpRestriction{}
+	for _, address := range egress.Ips {
+		ip, err := AddressPrefix(address, families)
+		if err != nil {
+			return nil, err
+		}
+		if ip == "" {
+			continue
+		}
+		if _, exist := ipsMap[ip]; !exist {
+			gatewayIPs = append(gatewayIPs, IpRestriction{
+				IP:          ip,
+				Description: fmt.Sprintf("%s_kubeGW_%s", ipRestrictionOwner(cluster), crd.UID),
+			})
+		}
+	}
+	for i := range egress.Groups {
+		ip, err := AddressPrefix(egress.Groups[i].Ip, families)
+		if err != nil {
+			return nil, err
+		}
+		_, exist := ipsMap[ip]
+		egress.Groups[i].Gateway = ip != "" && !exist
+	}
+	if len(gatewayIPs) == 0 {
+		return newIPs, nil
+	}
+
+	// if the ip is not one of the nodes that mean the kubernetes cluster use a gateway
+	// so only return gateway public ip
+	egress.Gateway = true
+	// in Probe mode, the nodes of the groups whose probe answered with a node ip egress with their own ips
+	direct := corev1.NodeList{}
+	for _, node := range nodes.Items {
+		if group := egressGroupOf(*egress, node); group != nil && !group.Gateway {
+			direct.Items = append(direct.Items, node)
+		}
+	}
+	if len(direct.Items) == 0 {
+		return gatewayIPs, nil
+	}
+	internal, err := getKubeInternalAddress(ctx, cluster, direct, crd)
 	if err != nil {
 		return nil, err
 	}
-
-	resBody, err := io.ReadAll(res.Body)
+	nodeIPs, err := getKubePublicAddesses(ctx, cluster, direct, crd, internal, &v1alpha1.EgressStatus{})
 	if err != nil {
 		return nil, err
 	}
-	ip := strings.TrimSpace(string(resBody))
-	ipMask := fmt.Sprintf("%s%s", ip, Mask)
-	logger.V(1).Info(fmt.Sprintf("Ifconfig IPs: %s", ipMask))
-
-	// check if public ip return by ifconfig.io is one of the kubernetes node
-	_, exist := ipsMap[ipMask]
-	if !exist {
-		// if the ip is not one of the nodes that mean the kubernetes cluster use a gateway
-		// so only return gateway public ip
-		newIPs = []IpRestriction{
-			{
-				IP:          ipMask,
-				Description: fmt.Sprintf("%s_kubeGW_%s", ipRestrictionPrefix, crd.UID),
-			},
-		}
+	return append(nodeIPs, gatewayIPs...), nil
+}
+
+const (
+	// DefaultResyncInterval is the default delay between two syncs of a Database without change
+	DefaultResyncInterval = 30 * time.Minute
+
+	ipRestrictionPrefix = "K8S-CDB-Operator"
+	databaseFinalizer   = "cloud.ovh.net/finalizer"
+
+	// reasons of the events recorded on the crd
+	eventReasonAdded          = "IpRestrictionsAdded"
+	eventReasonRemoved        = "IpRestrictionsRemoved"
+	eventReasonRevoked        = "IpRestrictionsRevoked"
+	eventReasonGatewayMode    = "EgressGatewayModeChanged"
+	eventReasonApiError       = "OvhApiError"
+	eventReasonServiceSkipped = "ServiceSkipped"
+	eventReasonDryRun         = "DryRun"
+	eventReasonBlocked        = "SyncBlocked"
+	eventReasonConflict       = "ConcurrentChange"
+	eventReasonApplyTimeout   = "ApplyTimeout"
+)
+
+// IpRestrictionDescription returns the description of the entry of the node, authorized by the operator of the cluster for the crd
+func IpRestrictionDescription(cluster string, node corev1.Node, crd v1alpha1.Database) string {
+	return fmt.Sprintf("%s_%s_%s_%s", ipRestrictionOwner(cluster), node.Name, crd.UID, node.UID)
+}
+
+// ipRestrictionOwner returns the start of the descriptions of the entries authorized by the operator of the cluster,
+// the entries of an operator without cluster name only hold the prefix, as the ones created before the cluster names
+func ipRestrictionOwner(cluster string) string {
+	if cluster == "" {
+		return ipRestrictionPrefix
 	}
-	return newIPs, nil
+	return ipRestrictionPrefix + ":" + cluster
 }
 
-const ipRestrictionPrefix = "K8S-CDB-Operator"
+// IpRestrictionCluster returns the cluster name of an entry authorized by the operator, empty for the entries
+// without cluster name, and false for the entries not authorized by the operator
+func IpRestrictionCluster(ip IpRestriction) (string, bool) {
+	rest, ok := strings.CutPrefix(ip.Description, ipRestrictionPrefix)
+	if !ok {
+		return "", false
+	}
+	if cluster, ok := strings.CutPrefix(rest, ":"); ok {
+		cluster, _, _ = strings.Cut(cluster, "_")
+		return cluster, true
+	}
+	return "", true
+}
 
-func IpRestrictionDescription(node corev1.Node, crd v1alpha1.Database) string {
-	return fmt.Sprintf("%s_%s_%s_%s", ipRestrictionPrefix, node.Name, crd.UID, node.UID)
+// IsIpRestrictionOwnedBy checks if the ip restriction was created by the operator for the given crd
+func IsIpRestrictionOwnedBy(ip IpRestriction, crd v1alpha1.Database) bool {
+	if !strings.HasPrefix(ip.Description, ipRestrictionPrefix) {
+		return false
+	}
+	for _, part := range strings.Split(ip.Description, "_") {
+		if part == string(crd.UID) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,1169 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ovh/go-ovh/ovh"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	"github.com/ovh/public-cloud-databases-operator/api/v1alpha1"
+)
+
+const (
+	testProjectId = "project"
+	testServiceId = "service"
+)
+
+var testManualIp = IpRestriction{IP: "203.0.113.1/32", Description: "office"}
+
+func newTestReconciler(t *testing.T, objs ...client.Object) (*DatabaseReconciler, *FakeOvhApi) {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	ovhApi := NewFakeOvhApi()
+	ovhApi.AddService(testProjectId, Cluster{
+		ID:          testServiceId,
+		Engine:      "postgresql",
+		NetworkType: "private",
+		Ips:         []IpRestriction{testManualIp},
+	})
+
+	k8sClient := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(objs...).
+		WithStatusSubresource(&v1alpha1.Database{}).
+		Build()
+	return &DatabaseReconciler{
+		Client:    k8sClient,
+		Scheme:    scheme,
+		Recorder:  record.NewFakeRecorder(100),
+		OvhClient: ovhApi,
+	}, ovhApi
+}
+
+func newTestNode(name string, ip string, nodeLabels map[string]string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, UID: types.UID(name + "-uid"), Labels: nodeLabels},
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: ip}},
+		},
+	}
+}
+
+func newTestDatabase(selector *metav1.LabelSelector) *v1alpha1.Database {
+	return &v1alpha1.Database{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default", UID: "db-uid"},
+		Spec: v1alpha1.DatabaseSpec{
+			ProjectId:     testProjectId,
+			ServiceId:     testServiceId,
+			LabelSelector: selector,
+		},
+	}
+}
+
+func reconcileDatabase(t *testing.T, r *DatabaseReconciler, database *v1alpha1.Database) error {
+	t.Helper()
+	_, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(database)})
+	return err
+}
+
+func TestReconcileAuthorizesSelectedNodes(t *testing.T) {
+	database := newTestDatabase(&metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: "nodepool", Operator: metav1.LabelSelectorOpIn, Values: []string{"db-clients", "batch"}},
+		},
+	})
+	r, ovhApi := newTestReconciler(t,
+		database,
+		newTestNode("node-1", "10.0.0.1", map[string]string{"nodepool": "db-clients"}),
+		newTestNode("node-2", "10.0.0.2", map[string]string{"nodepool": "ingress"}),
+	)
+
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+
+	cluster, _ := ovhApi.Service(testProjectId, testServiceId)
+	// the manual entry is left in place, the new entries are added after it
+	if len(cluster.Ips) != 2 || cluster.Ips[0] != testManualIp || cluster.Ips[1].IP != "10.0.0.1/32" {
+		t.Fatalf("unexpected ip restrictions: %+v", cluster.Ips)
+	}
+
+	got := &v1alpha1.Database{}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(database), got); err != nil {
+		t.Fatal(err)
+	}
+	if !meta.IsStatusConditionTrue(got.Status.Conditions, v1alpha1.ConditionReady) {
+		t.Errorf("expected Ready condition, got %+v", got.Status.Conditions)
+	}
+	if len(got.Status.Services) != 1 || len(got.Status.Services[0].AuthorizedIps) != 1 {
+		t.Errorf("unexpected services status: %+v", got.Status.Services)
+	}
+	if len(got.Finalizers) != 1 {
+		t.Errorf("expected finalizer, got %v", got.Finalizers)
+	}
+}
+
+func TestReconcileRevokesIpsOnDeletion(t *testing.T) {
+	database := newTestDatabase(nil)
+	r, ovhApi := newTestReconciler(t, database, newTestNode("node-1", "10.0.0.1", nil))
+
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if err := r.Delete(context.Background(), database); err != nil {
+		t.Fatal(err)
+	}
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+
+	cluster, _ := ovhApi.Service(testProjectId, testServiceId)
+	if len(cluster.Ips) != 1 || cluster.Ips[0] != testManualIp {
+		t.Fatalf("unexpected ip restrictions: %+v", cluster.Ips)
+	}
+	err := r.Get(context.Background(), client.ObjectKeyFromObject(database), &v1alpha1.Database{})
+	if err == nil {
+		t.Fatal("expected the database to be released")
+	}
+}
+
+func TestReconcileReleasesDatabaseOfInaccessibleProject(t *testing.T) {
+	missing := newTestDatabase(nil)
+	missing.Spec.ProjectId = "missing"
+	missing.Spec.ServiceId = ""
+	forbidden := newTestDatabase(nil)
+	forbidden.Name = "forbidden"
+	forbidden.Spec.ServiceId = ""
+	r, ovhApi := newTestReconciler(t, missing, forbidden, newTestNode("node-1", "10.0.0.1", nil))
+	ovhApi.InjectError(FakeGetServicesForProjectId, &ovh.APIError{Code: http.StatusForbidden, Message: "forbidden"})
+	ovhApi.InjectError(FakeGetServicesForProjectId, &ovh.APIError{Code: http.StatusForbidden, Message: "forbidden"})
+
+	for _, crd := range []*v1alpha1.Database{forbidden, missing} {
+		if err := reconcileDatabase(t, r, crd); err != nil {
+			t.Fatalf("reconcile failed: %v", err)
+		}
+		if err := r.Delete(context.Background(), crd); err != nil {
+			t.Fatal(err)
+		}
+		if err := reconcileDatabase(t, r, crd); err != nil {
+			t.Fatalf("reconcile failed: %v", err)
+		}
+		if err := r.Get(context.Background(), client.ObjectKeyFromObject(crd), &v1alpha1.Database{}); !apierrors.IsNotFound(err) {
+			t.Errorf("expected %s to be released, got %v", crd.Name, err)
+		}
+	}
+}
+
+func TestReconcileReportsOvhApiError(t *testing.T) {
+	database := newTestDatabase(nil)
+	r, ovhApi := newTestReconciler(t, database, newTestNode("node-1", "10.0.0.1", nil))
+	ovhApi.InjectError(FakeGetCluster, &ovh.APIError{Code: http.StatusForbidden, Message: "forbidden"})
+
+	// a permanent error is only reported in the status, and retried on the next periodic sync
+	res, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(database)})
+	if err != nil || res.RequeueAfter != DefaultResyncInterval {
+		t.Fatalf("expected a periodic sync, got %+v, %v", res, err)
+	}
+	if ovhApi.Calls(FakeUpdateClusterNodeIps) != 0 || ovhApi.Calls(FakeAddIpRestriction) != 0 {
+		t.Error("expected no update of the service")
+	}
+
+	got := &v1alpha1.Database{}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(database), got); err != nil {
+		t.Fatal(err)
+	}
+	synced := meta.FindStatusCondition(got.Status.Conditions, v1alpha1.ConditionSynced)
+	if synced == nil || synced.Status != metav1.ConditionFalse || synced.Reason != reasonApiError {
+		t.Errorf("unexpected Synced condition: %+v", synced)
+	}
+}
+
+func TestReconcileAuthorizesGatewayOnPublicService(t *testing.T) {
+	database := newTestDatabase(nil)
+	database.Spec.EgressDiscovery = &v1alpha1.EgressDiscovery{
+		Mode:      v1alpha1.EgressDiscoveryStatic,
+		StaticIps: []string{"198.51.100.1"},
+	}
+	r, ovhApi := newTestReconciler(t, database, newTestNode("node-1", "10.0.0.1", nil))
+	ovhApi.AddService(testProjectId, Cluster{ID: testServiceId, Engine: "postgresql", NetworkType: "public"})
+
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+
+	cluster, _ := ovhApi.Service(testProjectId, testServiceId)
+	if len(cluster.Ips) != 1 || cluster.Ips[0].IP != "198.51.100.1/32" {
+		t.Fatalf("unexpected ip restrictions: %+v", cluster.Ips)
+	}
+	got := &v1alpha1.Database{}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(database), got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.Egress == nil || !got.Status.Egress.Gateway {
+		t.Errorf("unexpected egress status: %+v", got.Status.Egress)
+	}
+}
+
+func TestReconcileReadsEgressIpsOfService(t *testing.T) {
+	database := newTestDatabase(nil)
+	database.Spec.EgressDiscovery = &v1alpha1.EgressDiscovery{Mode: v1alpha1.EgressDiscoveryAnnotation, ServiceName: "egress"}
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "egress",
+			Namespace:   database.Namespace,
+			Annotations: map[string]string{DefaultEgressAnnotation: "198.51.100.1, 198.51.100.2"},
+		},
+	}
+	r, ovhApi := newTestReconciler(t, database, newTestNode("node-1", "10.0.0.1", nil))
+	ovhApi.AddService(testProjectId, Cluster{ID: testServiceId, Engine: "postgresql", NetworkType: "public"})
+	// the services are not cached, they are only read from the api server
+	apiReader, _ := newTestReconciler(t, service)
+	r.APIReader = apiReader.Client
+
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	cluster, _ := ovhApi.Service(testProjectId, testServiceId)
+	if ips := ipsOf(cluster.Ips); !reflect.DeepEqual(ips, []string{"198.51.100.1/32", "198.51.100.2/32"}) {
+		t.Errorf("expected the ips of the service annotation, got %v", ips)
+	}
+}
+
+func TestReconcileProbesEgressOfNodeGroups(t *testing.T) {
+	database := newTestDatabase(nil)
+	database.Spec.EgressDiscovery = &v1alpha1.EgressDiscovery{Mode: v1alpha1.EgressDiscoveryProbe}
+	r, ovhApi := newTestReconciler(t,
+		database,
+		newTestNode("node-1", "10.0.0.1", map[string]string{"nodepool": "a"}),
+		newTestNode("node-2", "10.0.0.2", map[string]string{"nodepool": "a"}),
+		newTestNode("node-3", "10.0.0.3", map[string]string{"nodepool": "b"}),
+	)
+	ovhApi.AddService(testProjectId, Cluster{ID: testServiceId, Engine: "postgresql", NetworkType: "public"})
+
+	res, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(database)})
+	if err != nil || res.RequeueAfter == 0 {
+		t.Fatalf("expected a requeue while the probes run, got %+v, %v", res, err)
+	}
+
+	pods := corev1.PodList{}
+	if err := r.List(context.Background(), &pods); err != nil {
+		t.Fatal(err)
+	}
+	if len(pods.Items) != 2 {
+		t.Fatalf("expected one probe per nodepool, got %d", len(pods.Items))
+	}
+	if command := pods.Items[0].Spec.Containers[0].Command; command[0] != "curl" || command[len(command)-1] != DefaultEgressEchoURL {
+		t.Errorf("expected the echo url to be passed to curl, got %v", command)
+	}
+	for i, pod := range pods.Items {
+		pod.Status.Phase = corev1.PodSucceeded
+		pod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Message: fmt.Sprintf("198.51.100.%d\n", i+1)}},
+		}}
+		if err := r.Status().Update(context.Background(), &pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	cluster, _ := ovhApi.Service(testProjectId, testServiceId)
+	if len(cluster.Ips) != 2 {
+		t.Fatalf("expected the two gateways to be authorized, got %+v", cluster.Ips)
+	}
+	if err := r.List(context.Background(), &pods); err != nil || len(pods.Items) != 0 {
+		t.Errorf("expected the probes to be deleted, got %d, %v", len(pods.Items), err)
+	}
+
+	// the results are not shared with a Database requesting another echo url
+	other := newTestDatabase(nil)
+	other.Name, other.UID = "other", "other-uid"
+	other.Spec.EgressDiscovery = &v1alpha1.EgressDiscovery{Mode: v1alpha1.EgressDiscoveryProbe, EchoURL: "http://echo.example.com"}
+	if err := r.Create(context.Background(), other); err != nil {
+		t.Fatal(err)
+	}
+	res, err = r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(other)})
+	if err != nil || res.RequeueAfter == 0 {
+		t.Fatalf("expected a requeue while the probes run, got %+v, %v", res, err)
+	}
+	if err := r.List(context.Background(), &pods); err != nil || len(pods.Items) != 2 {
+		t.Errorf("expected new probes for the other echo url, got %d, %v", len(pods.Items), err)
+	}
+}
+
+func TestReconcileWaitsForProbeCreatedMeanwhile(t *testing.T) {
+	database := newTestDatabase(nil)
+	database.Spec.EgressDiscovery = &v1alpha1.EgressDiscovery{Mode: v1alpha1.EgressDiscoveryProbe}
+	r, ovhApi := newTestReconciler(t, database, newTestNode("node-1", "10.0.0.1", nil))
+	ovhApi.AddService(testProjectId, Cluster{ID: testServiceId, Engine: "postgresql", NetworkType: "public"})
+	// the cache does not hold the probe pods yet
+	r.Client = interceptor.NewClient(r.Client.(client.WithWatch), interceptor.Funcs{
+		Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+			if _, ok := obj.(*corev1.Pod); ok {
+				return apierrors.NewNotFound(corev1.Resource("pods"), key.Name)
+			}
+			return c.Get(ctx, key, obj, opts...)
+		},
+	})
+
+	for i := 0; i < 2; i++ {
+		res, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(database)})
+		if err != nil || res.RequeueAfter != egressProbePollInterval {
+			t.Fatalf("expected a requeue while the probe runs, got %+v, %v", res, err)
+		}
+	}
+	got := &v1alpha1.Database{}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(database), got); err != nil {
+		t.Fatal(err)
+	}
+	if condition := meta.FindStatusCondition(got.Status.Conditions, v1alpha1.ConditionSynced); condition == nil || condition.Reason != reasonProbePending {
+		t.Errorf("unexpected Synced condition: %+v", condition)
+	}
+}
+
+func TestReconcileProbesMixedEgressOfNodeGroups(t *testing.T) {
+	database := newTestDatabase(nil)
+	database.Spec.EgressDiscovery = &v1alpha1.EgressDiscovery{Mode: v1alpha1.EgressDiscoveryProbe}
+	nodes := []*corev1.Node{
+		newTestNode("a1", "10.0.0.1", map[string]string{"nodepool": "a"}),
+		newTestNode("a2", "10.0.0.2", map[string]string{"nodepool": "a"}),
+		newTestNode("b1", "10.0.0.3", map[string]string{"nodepool": "b"}),
+	}
+	for i, node := range nodes {
+		node.Status.Addresses = append(node.Status.Addresses, corev1.NodeAddress{Type: corev1.NodeExternalIP, Address: fmt.Sprintf("198.51.100.%d", i+10)})
+	}
+	r, ovhApi := newTestReconciler(t, database, nodes[0], nodes[1], nodes[2])
+	ovhApi.AddService(testProjectId, Cluster{ID: testServiceId, Engine: "postgresql", NetworkType: "public"})
+
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(database)}); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	// the nodepool a egresses with the ip of its nodes, the nodepool b through a gateway
+	egressIps := map[string]string{
+		"topology.kubernetes.io/zone=,nodepool=a": "198.51.100.10",
+		"topology.kubernetes.io/zone=,nodepool=b": "203.0.113.50",
+	}
+	pods := corev1.PodList{}
+	if err := r.List(context.Background(), &pods); err != nil {
+		t.Fatal(err)
+	}
+	for _, pod := range pods.Items {
+		pod.Status.Phase = corev1.PodSucceeded
+		pod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Message: egressIps[pod.Annotations[EgressProbeLabel]]}},
+		}}
+		if err := r.Status().Update(context.Background(), &pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	cluster, _ := ovhApi.Service(testProjectId, testServiceId)
+	ips := ipsOf(cluster.Ips)
+	sort.Strings(ips)
+	expected := []string{"10.0.0.1/32", "10.0.0.2/32", "198.51.100.10/32", "198.51.100.11/32", "203.0.113.50/32"}
+	if !reflect.DeepEqual(ips, expected) {
+		t.Errorf("expected the nodes of the nodepool a and the gateway of the nodepool b, got %v", ips)
+	}
+
+	got := &v1alpha1.Database{}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(database), got); err != nil {
+		t.Fatal(err)
+	}
+	if egress := got.Status.Egress; egress == nil || !egress.Gateway || len(egress.Groups) != 2 || egress.Groups[0].Gateway || !egress.Groups[1].Gateway {
+		t.Errorf("unexpected egress status: %+v", got.Status.Egress)
+	}
+	for _, node := range nodes {
+		want := []string{"10.0.0.1/32", "198.51.100.10/32"}
+		switch node.Name {
+		case "a2":
+			want = []string{"10.0.0.2/32", "198.51.100.11/32"}
+		case "b1":
+			want = []string{"203.0.113.50/32"}
+		}
+		if ips, err := nodeIps(context.Background(), "", *got, *node, "public"); err != nil || !reflect.DeepEqual(ips, want) {
+			t.Errorf("unexpected ips of %s: %v, %v", node.Name, ips, err)
+		}
+	}
+}
+
+func TestReconcileSkipsUpdateWhenUpToDate(t *testing.T) {
+	database := newTestDatabase(nil)
+	r, ovhApi := newTestReconciler(t,
+		database,
+		newTestNode("node-1", "10.0.0.1", nil),
+		newTestNode("node-2", "10.0.0.2", nil),
+	)
+
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	// the order of the entries returned by the api does not matter
+	cluster, _ := ovhApi.Service(testProjectId, testServiceId)
+	cluster.Ips[0], cluster.Ips[2] = cluster.Ips[2], cluster.Ips[0]
+	ovhApi.AddService(testProjectId, cluster)
+
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if calls := ovhApi.Calls(FakeAddIpRestriction); calls != 2 {
+		t.Errorf("expected the 2 nodes to be added once, got %d", calls)
+	}
+	events := r.Recorder.(*record.FakeRecorder).Events
+	if len(events) != 1 {
+		t.Errorf("expected a single event, got %d", len(events))
+	}
+}
+
+func TestReconcileFallsBackToFullUpdate(t *testing.T) {
+	database := newTestDatabase(nil)
+	r, ovhApi := newTestReconciler(t,
+		database,
+		newTestNode("node-1", "10.0.0.1", nil),
+		newTestNode("node-2", "10.0.0.2", nil),
+	)
+	ovhApi.InjectError(FakeAddIpRestriction, &ovh.APIError{Code: http.StatusMethodNotAllowed, Message: "not allowed"})
+
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if calls := ovhApi.Calls(FakeUpdateClusterNodeIps); calls != 1 {
+		t.Errorf("expected a full update, got %d", calls)
+	}
+	cluster, _ := ovhApi.Service(testProjectId, testServiceId)
+	if diff := DiffIpRestrictions(cluster.Ips, []IpRestriction{
+		{IP: "10.0.0.1/32", Description: "K8S-CDB-Operator_node-1_db-uid_node-1-uid"},
+		{IP: "10.0.0.2/32", Description: "K8S-CDB-Operator_node-2_db-uid_node-2-uid"},
+		testManualIp,
+	}); !diff.IsEmpty() {
+		t.Errorf("unexpected ip restrictions: %s", diff)
+	}
+}
+
+func TestReconcileAbortsOnConcurrentChange(t *testing.T) {
+	database := newTestDatabase(nil)
+	r, ovhApi := newTestReconciler(t, database, newTestNode("node-1", "10.0.0.1", nil))
+	ovhApi.InjectError(FakeAddIpRestriction, &ovh.APIError{Code: http.StatusMethodNotAllowed, Message: "not allowed"})
+	// an entry is added by hand once the operator read the service
+	vpn := IpRestriction{IP: "198.51.100.1/32", Description: "vpn"}
+	ovhApi.OnGetCluster(func() {
+		cluster, _ := ovhApi.Service(testProjectId, testServiceId)
+		cluster.Ips = append(cluster.Ips, vpn)
+		ovhApi.AddService(testProjectId, cluster)
+	})
+	conflicts := testutil.ToFloat64(ipRestrictionConflicts.WithLabelValues(testProjectId, testServiceId))
+
+	res, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(database)})
+	if err != nil || res.RequeueAfter == 0 {
+		t.Fatalf("expected a requeue, got %+v, %v", res, err)
+	}
+	if calls := ovhApi.Calls(FakeUpdateClusterNodeIps); calls != 0 {
+		t.Errorf("expected the update to be aborted, got %d", calls)
+	}
+	if got := testutil.ToFloat64(ipRestrictionConflicts.WithLabelValues(testProjectId, testServiceId)) - conflicts; got != 1 {
+		t.Errorf("expected a conflict to be counted, got %v", got)
+	}
+	got := &v1alpha1.Database{}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(database), got); err != nil {
+		t.Fatal(err)
+	}
+	synced := meta.FindStatusCondition(got.Status.Conditions, v1alpha1.ConditionSynced)
+	if synced == nil || synced.Reason != reasonConflict {
+		t.Errorf("unexpected Synced condition: %+v", synced)
+	}
+
+	// the next sync keeps the new entry
+	ovhApi.InjectError(FakeAddIpRestriction, &ovh.APIError{Code: http.StatusMethodNotAllowed, Message: "not allowed"})
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	cluster, _ := ovhApi.Service(testProjectId, testServiceId)
+	if diff := DiffIpRestrictions(cluster.Ips, []IpRestriction{
+		{IP: "10.0.0.1/32", Description: "K8S-CDB-Operator_node-1_db-uid_node-1-uid"},
+		testManualIp,
+		vpn,
+	}); !diff.IsEmpty() {
+		t.Errorf("unexpected ip restrictions: %s", diff)
+	}
+}
+
+func TestReconcileWaitsForIpRestrictionsToBeApplied(t *testing.T) {
+	database := newTestDatabase(nil)
+	r, ovhApi := newTestReconciler(t, database, newTestNode("node-1", "10.0.0.1", nil))
+	request := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(database)}
+	expectApplied := func(status metav1.ConditionStatus, reason string, state string) {
+		t.Helper()
+		got := &v1alpha1.Database{}
+		if err := r.Get(context.Background(), client.ObjectKeyFromObject(database), got); err != nil {
+			t.Fatal(err)
+		}
+		applied := meta.FindStatusCondition(got.Status.Conditions, v1alpha1.ConditionApplied)
+		if applied == nil || applied.Status != status || applied.Reason != reason {
+			t.Errorf("unexpected Applied condition: %+v", applied)
+		}
+		states := got.Status.Services[0].IpStates
+		if len(states) != 1 || states[0] != (v1alpha1.IpState{Ip: "10.0.0.1/32", State: state}) {
+			t.Errorf("unexpected ip states: %+v", states)
+		}
+	}
+	setStatus := func(status string) {
+		cluster, _ := ovhApi.Service(testProjectId, testServiceId)
+		cluster.IpStatus = map[string]string{"10.0.0.1/32": status}
+		ovhApi.AddService(testProjectId, cluster)
+	}
+
+	// the service is polled until the new ip is active
+	res, err := r.Reconcile(context.Background(), request)
+	if err != nil || res.RequeueAfter != appliedPollInterval {
+		t.Fatalf("expected a poll, got %+v, %v", res, err)
+	}
+	expectApplied(metav1.ConditionFalse, reasonApplying, IpStatePending)
+
+	setStatus("UPDATING")
+	res, err = r.Reconcile(context.Background(), request)
+	if err != nil || res.RequeueAfter != appliedPollInterval {
+		t.Fatalf("expected a poll, got %+v, %v", res, err)
+	}
+	expectApplied(metav1.ConditionFalse, reasonApplying, "UPDATING")
+
+	setStatus(IpStateReady)
+	res, err = r.Reconcile(context.Background(), request)
+	if err != nil || res.RequeueAfter != DefaultResyncInterval {
+		t.Fatalf("expected a periodic sync, got %+v, %v", res, err)
+	}
+	expectApplied(metav1.ConditionTrue, reasonApplied, IpStateReady)
+
+	// the polling stops once the timeout elapsed since the last change
+	r.ApplyTimeout = time.Nanosecond
+	setStatus("UPDATING")
+	res, err = r.Reconcile(context.Background(), request)
+	if err != nil || res.RequeueAfter != DefaultResyncInterval {
+		t.Fatalf("expected a periodic sync, got %+v, %v", res, err)
+	}
+	expectApplied(metav1.ConditionFalse, reasonApplyTimeout, "UPDATING")
+	events := r.Recorder.(*record.FakeRecorder).Events
+	found := false
+	for len(events) > 0 {
+		if strings.HasPrefix(<-events, "Warning ApplyTimeout") {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("expected an ApplyTimeout event")
+	}
+}
+
+func TestReconcileTaintsNodesUntilAuthorized(t *testing.T) {
+	database := newTestDatabase(nil)
+	startupTaint := corev1.Taint{Key: "nodepool.example.com/startup", Effect: corev1.TaintEffectNoSchedule}
+	fresh := newTestNode("node-2", "10.0.0.2", nil)
+	fresh.Spec.Taints = []corev1.Taint{startupTaint}
+	r, ovhApi := newTestReconciler(t, database, newTestNode("node-1", "10.0.0.1", nil), fresh)
+	r.NodeTaints = NodeTaintsConfig{Mode: NodeTaintModeAdd}
+	expectTaints := func(name string, want ...corev1.Taint) {
+		t.Helper()
+		node := &corev1.Node{}
+		if err := r.Get(context.Background(), client.ObjectKey{Name: name}, node); err != nil {
+			t.Fatal(err)
+		}
+		if len(node.Spec.Taints) != len(want) {
+			t.Fatalf("unexpected taints on %s: %+v", name, node.Spec.Taints)
+		}
+		for i := range want {
+			if !node.Spec.Taints[i].MatchTaint(&want[i]) {
+				t.Errorf("unexpected taints on %s: %+v", name, node.Spec.Taints)
+			}
+		}
+	}
+	setStatus := func(node1 string, node2 string) {
+		cluster, _ := ovhApi.Service(testProjectId, testServiceId)
+		cluster.IpStatus = map[string]string{"10.0.0.1/32": node1, "10.0.0.2/32": node2}
+		ovhApi.AddService(testProjectId, cluster)
+	}
+	taint := corev1.Taint{Key: DefaultNodeTaintKey, Effect: corev1.TaintEffectNoSchedule}
+
+	// the nodes are tainted until their ips are active
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	expectTaints("node-1", taint)
+	expectTaints("node-2", startupTaint, taint)
+
+	setStatus(IpStateReady, "UPDATING")
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	expectTaints("node-1")
+	expectTaints("node-2", startupTaint, taint)
+
+	// only the startup taint of the node pool is removed in remove mode
+	r.NodeTaints = NodeTaintsConfig{Mode: NodeTaintModeRemove, Key: startupTaint.Key}
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	expectTaints("node-2", startupTaint, taint)
+	setStatus(IpStateReady, IpStateReady)
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	expectTaints("node-1")
+	expectTaints("node-2", taint)
+
+	// a Database failing to sync does not taint the nodes it authorized
+	r.NodeTaints = NodeTaintsConfig{Mode: NodeTaintModeAdd}
+	other := newTestDatabase(nil)
+	other.Name, other.UID = "other", "other-uid"
+	if err := r.Create(context.Background(), other); err != nil {
+		t.Fatal(err)
+	}
+	if err := reconcileDatabase(t, r, other); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	setStatus(IpStateReady, IpStateReady)
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	expectTaints("node-1")
+	ovhApi.InjectError(FakeGetCluster, &ovh.APIError{Code: http.StatusInternalServerError, Message: "internal error"})
+	if err := reconcileDatabase(t, r, other); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	expectTaints("node-1")
+
+	// the entries whose description changes are updated in place, and keep their access
+	if err := r.Delete(context.Background(), other); err != nil {
+		t.Fatal(err)
+	}
+	if err := reconcileDatabase(t, r, other); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	r.ClusterName = "prod"
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if calls := ovhApi.Calls(FakeUpdateIpRestriction); calls == 0 {
+		t.Fatal("expected the entries to be updated")
+	}
+	expectTaints("node-1")
+}
+
+func TestReconcileBacksOffOnBusyService(t *testing.T) {
+	database := newTestDatabase(nil)
+	r, ovhApi := newTestReconciler(t, database, newTestNode("node-1", "10.0.0.1", nil))
+	ovhApi.InjectError(FakeAddIpRestriction, &ovh.APIError{Code: http.StatusConflict, Message: "service is updating"})
+	ovhApi.InjectError(FakeAddIpRestriction, &ovh.APIError{Code: http.StatusConflict, Message: "service is updating"})
+
+	first, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(database)})
+	if err != nil || first.RequeueAfter == 0 {
+		t.Fatalf("expected a requeue, got %+v, %v", first, err)
+	}
+	second, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(database)})
+	if err != nil || second.RequeueAfter <= first.RequeueAfter {
+		t.Fatalf("expected a longer requeue, got %+v after %+v, %v", second, first, err)
+	}
+
+	got := &v1alpha1.Database{}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(database), got); err != nil {
+		t.Fatal(err)
+	}
+	synced := meta.FindStatusCondition(got.Status.Conditions, v1alpha1.ConditionSynced)
+	if synced == nil || synced.Reason != reasonApiTransient {
+		t.Errorf("unexpected Synced condition: %+v", synced)
+	}
+
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if calls := ovhApi.Calls(FakeAddIpRestriction); calls != 3 {
+		t.Errorf("expected 3 additions, got %d", calls)
+	}
+}
+
+func TestReconcileUsesCredentialsSecret(t *testing.T) {
+	database := newTestDatabase(nil)
+	database.Spec.CredentialsSecretRef = &v1alpha1.CredentialsSecretRef{Name: "team-a", Region: "ovh-ca"}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "team-a", Namespace: database.Namespace},
+		Data: map[string][]byte{
+			SecretKeyRegion:            []byte("ovh-eu"),
+			SecretKeyApplicationKey:    []byte("key"),
+			SecretKeyApplicationSecret: []byte("secret"),
+			SecretKeyConsumerKey:       []byte("consumer"),
+		},
+	}
+	r, defaultApi := newTestReconciler(t, database, secret, newTestNode("node-1", "10.0.0.1", nil))
+
+	teamApi := NewFakeOvhApi()
+	teamApi.AddService(testProjectId, Cluster{ID: testServiceId, Engine: "mysql", NetworkType: "private"})
+	var built []OvhCredentials
+	r.NewOvhApi = func(credentials OvhCredentials) (OvhApi, error) {
+		built = append(built, credentials)
+		return teamApi, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := reconcileDatabase(t, r, database); err != nil {
+			t.Fatalf("reconcile failed: %v", err)
+		}
+	}
+
+	if len(built) != 1 || built[0].Region != "ovh-ca" || built[0].ConsumerKey != "consumer" {
+		t.Errorf("expected a single client built for ovh-ca, got %+v", built)
+	}
+	if defaultApi.Calls(FakeGetCluster) != 0 {
+		t.Error("expected the default client not to be used")
+	}
+	cluster, _ := teamApi.Service(testProjectId, testServiceId)
+	if len(cluster.Ips) != 1 {
+		t.Errorf("unexpected ip restrictions: %+v", cluster.Ips)
+	}
+
+	// the secret deleted along with the namespace is kept until the ips are revoked, even after a restart
+	r.ovhClients = ovhClientCache{}
+	for _, object := range []client.Object{secret, database} {
+		if err := r.Delete(context.Background(), object); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if cluster, _ := teamApi.Service(testProjectId, testServiceId); len(cluster.Ips) != 0 {
+		t.Errorf("expected the ips to be revoked, got %+v", cluster.Ips)
+	}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(secret), &corev1.Secret{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the secret to be released, got %v", err)
+	}
+}
+
+func TestReconcileReleasesDatabaseWithMissingCredentials(t *testing.T) {
+	database := newTestDatabase(nil)
+	database.Spec.CredentialsSecretRef = &v1alpha1.CredentialsSecretRef{Name: "missing"}
+	synced := newTestDatabase(nil)
+	synced.Name = "synced"
+	synced.Spec.CredentialsSecretRef = &v1alpha1.CredentialsSecretRef{Name: "missing"}
+	synced.Status.Services = []v1alpha1.ServiceStatus{{ServiceId: testServiceId, AuthorizedIps: []string{"10.0.0.1/32"}}}
+	r, _ := newTestReconciler(t, database, synced, newTestNode("node-1", "10.0.0.1", nil))
+
+	for _, crd := range []*v1alpha1.Database{database, synced} {
+		if err := reconcileDatabase(t, r, crd); err != nil {
+			t.Fatalf("reconcile failed: %v", err)
+		}
+		if err := r.Delete(context.Background(), crd); err != nil {
+			t.Fatal(err)
+		}
+		if err := reconcileDatabase(t, r, crd); err != nil {
+			t.Fatalf("reconcile failed: %v", err)
+		}
+	}
+
+	// the Database which never authorized any ip is released without credentials
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(database), &v1alpha1.Database{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the database to be released, got %v", err)
+	}
+
+	// the ips of the other one can not be revoked, which is reported in its status
+	got := &v1alpha1.Database{}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(synced), got); err != nil {
+		t.Fatal(err)
+	}
+	condition := meta.FindStatusCondition(got.Status.Conditions, v1alpha1.ConditionSynced)
+	if condition == nil || condition.Status != metav1.ConditionFalse || condition.Reason != reasonCredentials ||
+		!strings.Contains(condition.Message, "failed to revoke") {
+		t.Errorf("unexpected Synced condition: %+v", condition)
+	}
+}
+
+func TestReconcileReportsMissingAccessRules(t *testing.T) {
+	database := newTestDatabase(nil)
+	r, ovhApi := newTestReconciler(t, database, newTestNode("node-1", "10.0.0.1", nil))
+	ovhApi.SetCurrentCredential(Credential{
+		CredentialId: 42,
+		Status:       CredentialStatusValidated,
+		Rules: []AccessRule{
+			{Method: http.MethodGet, Path: "/cloud/project/*"},
+			{Method: http.MethodPut, Path: "/cloud/project/*/database/mongodb/*"},
+		},
+	})
+
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+
+	got := &v1alpha1.Database{}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(database), got); err != nil {
+		t.Fatal(err)
+	}
+	condition := meta.FindStatusCondition(got.Status.Conditions, v1alpha1.ConditionCredentialsValid)
+	if condition == nil || condition.Status != metav1.ConditionFalse || condition.Reason != reasonMissingAccessRules {
+		t.Fatalf("unexpected CredentialsValid condition: %+v", condition)
+	}
+	want := fmt.Sprintf("PUT /cloud/project/%s/database/postgresql/%s", testProjectId, testServiceId)
+	if !strings.Contains(condition.Message, want) || strings.Contains(condition.Message, "GET") {
+		t.Errorf("expected only %q to be missing, got %q", want, condition.Message)
+	}
+
+	// the credential is fetched once per check interval
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if calls := ovhApi.Calls(FakeGetCurrentCredential); calls != 1 {
+		t.Errorf("expected the credential to be cached, got %d calls", calls)
+	}
+}
+
+func TestReconcileRecordsMetrics(t *testing.T) {
+	database := newTestDatabase(nil)
+	database.Name = "db-metrics"
+	r, _ := newTestReconciler(t, database, newTestNode("node-1", "10.0.0.1", nil), newTestNode("node-2", "10.0.0.2", nil))
+	added := testutil.ToFloat64(ipRestrictionChanges.WithLabelValues(testProjectId, testServiceId, "added"))
+
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+
+	if got := testutil.ToFloat64(ipRestrictionChanges.WithLabelValues(testProjectId, testServiceId, "added")) - added; got != 2 {
+		t.Errorf("expected 2 added ip restrictions, got %v", got)
+	}
+	if got := testutil.ToFloat64(authorizedIpsCount.WithLabelValues(database.Namespace, database.Name, testProjectId, testServiceId)); got != 2 {
+		t.Errorf("expected 2 authorized ips, got %v", got)
+	}
+	if got := testutil.ToFloat64(lastSyncTimestamp.WithLabelValues(database.Namespace, database.Name)); got == 0 {
+		t.Error("expected the last sync timestamp to be set")
+	}
+}
+
+func TestReconcileRecordsEvents(t *testing.T) {
+	database := newTestDatabase(nil)
+	database.Spec.ServiceId = ""
+	node := newTestNode("node-1", "10.0.0.1", nil)
+	r, ovhApi := newTestReconciler(t, database, node, newTestNode("node-2", "10.0.0.2", nil))
+	ovhApi.AddService(testProjectId, Cluster{ID: "deleted", Engine: "mysql", NetworkType: "private"})
+	ovhApi.InjectError(FakeGetCluster, notFound("service deleted not found"))
+	recorder := r.Recorder.(*record.FakeRecorder)
+
+	expectEvents := func(want ...string) {
+		t.Helper()
+		for _, prefix := range want {
+			select {
+			case event := <-recorder.Events:
+				if !strings.HasPrefix(event, prefix) {
+					t.Errorf("expected event %q, got %q", prefix, event)
+				}
+			default:
+				t.Errorf("expected event %q, got none", prefix)
+			}
+		}
+		if len(recorder.Events) != 0 {
+			t.Errorf("unexpected event %q", <-recorder.Events)
+		}
+	}
+
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	expectEvents("Normal ServiceSkipped service deleted", "Normal IpRestrictionsAdded service service: added [10.0.0.1/32, 10.0.0.2/32]")
+
+	if err := r.Delete(context.Background(), node); err != nil {
+		t.Fatal(err)
+	}
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	expectEvents("Normal IpRestrictionsAdded service deleted", "Normal IpRestrictionsRemoved service service: removed [10.0.0.1/32]")
+
+	ovhApi.InjectError(FakeGetServicesForProjectId, &ovh.APIError{Code: http.StatusForbidden, Message: "forbidden"})
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	expectEvents("Warning OvhApiError")
+}
+
+func TestReconcileDryRunReportsPlannedChanges(t *testing.T) {
+	database := newTestDatabase(nil)
+	database.Spec.DryRun = true
+	r, ovhApi := newTestReconciler(t, database, newTestNode("node-1", "10.0.0.1", nil))
+
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+
+	if calls := ovhApi.Calls(FakeUpdateClusterNodeIps) + ovhApi.Calls(FakeAddIpRestriction); calls != 0 {
+		t.Errorf("expected no update in dry run, got %d", calls)
+	}
+	cluster, _ := ovhApi.Service(testProjectId, testServiceId)
+	if len(cluster.Ips) != 1 || cluster.Ips[0] != testManualIp {
+		t.Errorf("unexpected ip restrictions: %+v", cluster.Ips)
+	}
+
+	got := &v1alpha1.Database{}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(database), got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Status.Services) != 1 || len(got.Status.Services[0].PlannedAdditions) != 1 || got.Status.Services[0].PlannedAdditions[0] != "10.0.0.1/32" {
+		t.Errorf("unexpected services status: %+v", got.Status.Services)
+	}
+	// the planned ips are not reported as authorized
+	if len(got.Status.Services) != 1 || len(got.Status.Services[0].AuthorizedIps) != 0 || got.Status.LastSyncTime != nil {
+		t.Errorf("expected no authorized ip and no sync time, got %+v", got.Status)
+	}
+	condition := meta.FindStatusCondition(got.Status.Conditions, v1alpha1.ConditionSynced)
+	if condition == nil || condition.Status != metav1.ConditionFalse || condition.Reason != reasonDryRun {
+		t.Errorf("unexpected Synced condition: %+v", condition)
+	}
+	if event := <-r.Recorder.(*record.FakeRecorder).Events; !strings.HasPrefix(event, "Normal DryRun service service: would have added [10.0.0.1/32]") {
+		t.Errorf("unexpected event %q", event)
+	}
+
+	// the ips of a Database in dry run are not kept for it by the other Databases of the service
+	other := newTestDatabase(nil)
+	other.Name, other.UID = "other", "other-uid"
+	if err := r.Create(context.Background(), other); err != nil {
+		t.Fatal(err)
+	}
+	if err := reconcileDatabase(t, r, other); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(other), other); err != nil {
+		t.Fatal(err)
+	}
+	other.Spec.LabelSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"nodepool": "none"}}
+	if err := r.Update(context.Background(), other); err != nil {
+		t.Fatal(err)
+	}
+	if err := reconcileDatabase(t, r, other); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	cluster, _ = ovhApi.Service(testProjectId, testServiceId)
+	if len(cluster.Ips) != 1 || cluster.Ips[0] != testManualIp {
+		t.Errorf("expected the ip to be removed, got %+v", cluster.Ips)
+	}
+}
+
+func TestReconcileBlocksUnsafeRemovals(t *testing.T) {
+	database := newTestDatabase(nil)
+	nodes := []*corev1.Node{
+		newTestNode("node-1", "10.0.0.1", nil),
+		newTestNode("node-2", "10.0.0.2", nil),
+		newTestNode("node-3", "10.0.0.3", nil),
+	}
+	r, ovhApi := newTestReconciler(t, database, nodes[0], nodes[1], nodes[2])
+	r.SafetyGuards = SafetyGuardsConfig{MinNodes: 1, MaxRemovalPercent: 50}
+	key := client.ObjectKeyFromObject(database)
+	expectBlocked := func(reason string) {
+		t.Helper()
+		if err := reconcileDatabase(t, r, database); err != nil {
+			t.Fatalf("reconcile failed: %v", err)
+		}
+		got := &v1alpha1.Database{}
+		if err := r.Get(context.Background(), key, got); err != nil {
+			t.Fatal(err)
+		}
+		condition := meta.FindStatusCondition(got.Status.Conditions, v1alpha1.ConditionBlocked)
+		if condition == nil || condition.Status != metav1.ConditionTrue || condition.Reason != reason {
+			t.Errorf("expected to be blocked by %s, got %+v", reason, condition)
+		}
+		if cluster, _ := ovhApi.Service(testProjectId, testServiceId); len(cluster.Ips) != 4 {
+			t.Errorf("expected the ip restrictions to be kept, got %+v", cluster.Ips)
+		}
+	}
+
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+
+	// two of the three nodes are gone
+	for _, node := range nodes[:2] {
+		if err := r.Delete(context.Background(), node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectBlocked(reasonTooManyRemovals)
+
+	// no node left
+	if err := r.Delete(context.Background(), nodes[2]); err != nil {
+		t.Fatal(err)
+	}
+	expectBlocked(reasonTooFewNodes)
+
+	// the override lets a single sync through
+	got := &v1alpha1.Database{}
+	if err := r.Get(context.Background(), key, got); err != nil {
+		t.Fatal(err)
+	}
+	got.Annotations = map[string]string{SafetyGuardsOverrideAnnotation: "true"}
+	if err := r.Update(context.Background(), got); err != nil {
+		t.Fatal(err)
+	}
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if cluster, _ := ovhApi.Service(testProjectId, testServiceId); len(cluster.Ips) != 1 {
+		t.Errorf("expected the ip restrictions to be removed, got %+v", cluster.Ips)
+	}
+	if err := r.Get(context.Background(), key, got); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got.Annotations[SafetyGuardsOverrideAnnotation]; ok {
+		t.Error("expected the override annotation to be removed")
+	}
+	if !meta.IsStatusConditionFalse(got.Status.Conditions, v1alpha1.ConditionBlocked) {
+		t.Errorf("expected not to be blocked, got %+v", got.Status.Conditions)
+	}
+}
+
+func TestReconcileSharesServiceBetweenDatabases(t *testing.T) {
+	poolA := newTestDatabase(&metav1.LabelSelector{MatchLabels: map[string]string{"nodepool": "a"}})
+	poolA.Name, poolA.UID = "pool-a", "pool-a-uid"
+	all := newTestDatabase(nil)
+	all.Name, all.UID = "all", "all-uid"
+	all.Spec.ServiceId = ""
+	r, ovhApi := newTestReconciler(t, poolA, all,
+		newTestNode("node-1", "10.0.0.1", map[string]string{"nodepool": "a"}),
+		newTestNode("node-2", "10.0.0.2", map[string]string{"nodepool": "b"}),
+	)
+	ipsOwnedBy := func(crd *v1alpha1.Database) []string {
+		cluster, _ := ovhApi.Service(testProjectId, testServiceId)
+		owned := []string{}
+		for _, ip := range cluster.Ips {
+			if IsIpRestrictionOwnedBy(ip, *crd) {
+				owned = append(owned, ip.IP)
+			}
+		}
+		return owned
+	}
+
+	for _, crd := range []*v1alpha1.Database{poolA, all, poolA} {
+		if err := reconcileDatabase(t, r, crd); err != nil {
+			t.Fatalf("reconcile failed: %v", err)
+		}
+	}
+	// the ip wanted by both is authorized once
+	cluster, _ := ovhApi.Service(testProjectId, testServiceId)
+	if len(cluster.Ips) != 3 {
+		t.Fatalf("unexpected ip restrictions: %+v", cluster.Ips)
+	}
+	if owned := ipsOwnedBy(poolA); len(owned) != 1 || owned[0] != "10.0.0.1/32" {
+		t.Errorf("unexpected ips of pool-a: %v", owned)
+	}
+	if owned := ipsOwnedBy(all); len(owned) != 1 || owned[0] != "10.0.0.2/32" {
+		t.Errorf("unexpected ips of all: %v", owned)
+	}
+
+	// the ip of pool-a is still wanted by all
+	if err := r.Delete(context.Background(), poolA); err != nil {
+		t.Fatal(err)
+	}
+	if err := reconcileDatabase(t, r, poolA); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if err := reconcileDatabase(t, r, all); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	cluster, _ = ovhApi.Service(testProjectId, testServiceId)
+	if len(cluster.Ips) != 3 {
+		t.Fatalf("unexpected ip restrictions: %+v", cluster.Ips)
+	}
+	if owned := ipsOwnedBy(all); len(owned) != 2 {
+		t.Errorf("expected all to own both ips, got %v", owned)
+	}
+}
+
+func TestReconcileOnlyManagesEntriesOfItsCluster(t *testing.T) {
+	database := newTestDatabase(nil)
+	node := newTestNode("node-1", "10.0.0.1", nil)
+	r, ovhApi := newTestReconciler(t, database, node)
+	r.ClusterName = "paris"
+	r.SafetyGuards = SafetyGuardsConfig{MaxRemovalPercent: 50}
+	otherCluster := IpRestriction{IP: "10.1.0.1/32", Description: IpRestrictionDescription("london", *newTestNode("node-9", "10.1.0.1", nil), v1alpha1.Database{ObjectMeta: metav1.ObjectMeta{UID: "london-db-uid"}})}
+	unknownLegacy := IpRestriction{IP: "10.2.0.1/32", Description: "K8S-CDB-Operator_node-8_unknown-uid_node-8-uid"}
+	legacy := IpRestriction{IP: "10.0.0.1/32", Description: IpRestrictionDescription("", *node, *database)}
+	ovhApi.AddService(testProjectId, Cluster{
+		ID:          testServiceId,
+		Engine:      "postgresql",
+		NetworkType: "private",
+		Ips:         []IpRestriction{testManualIp, otherCluster, unknownLegacy, legacy},
+	})
+
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+
+	// the entry created before the cluster name was set is migrated, the others are left untouched
+	migrated := IpRestriction{IP: "10.0.0.1/32", Description: "K8S-CDB-Operator:paris_node-1_db-uid_node-1-uid"}
+	cluster, _ := ovhApi.Service(testProjectId, testServiceId)
+	diff := DiffIpRestrictions(cluster.Ips, []IpRestriction{migrated, testManualIp, otherCluster, unknownLegacy})
+	if !diff.IsEmpty() {
+		t.Errorf("unexpected ip restrictions: %s", diff)
+	}
+	// the ip keeps its access while its description is migrated
+	if ovhApi.Calls(FakeUpdateIpRestriction) != 1 || ovhApi.Calls(FakeDeleteIpRestriction) != 0 {
+		t.Errorf("expected the entry to be updated in place, got %d updates and %d deletions",
+			ovhApi.Calls(FakeUpdateIpRestriction), ovhApi.Calls(FakeDeleteIpRestriction))
+	}
+	if name, managed := IpRestrictionCluster(migrated); !managed || name != "paris" {
+		t.Errorf("unexpected cluster %q", name)
+	}
+
+	if err := r.Delete(context.Background(), database); err != nil {
+		t.Fatal(err)
+	}
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	cluster, _ = ovhApi.Service(testProjectId, testServiceId)
+	if diff := DiffIpRestrictions(cluster.Ips, []IpRestriction{testManualIp, otherCluster, unknownLegacy}); !diff.IsEmpty() {
+		t.Errorf("unexpected ip restrictions after deletion: %s", diff)
+	}
+}
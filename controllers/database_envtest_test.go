@@ -0,0 +1,130 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+
+	"github.com/ovh/public-cloud-databases-operator/api/v1alpha1"
+)
+
+var _ = Describe("Database controller", func() {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+		ovhApi *FakeOvhApi
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+		ovhApi = NewFakeOvhApi()
+		ovhApi.AddService(testProjectId, Cluster{
+			ID:          testServiceId,
+			Engine:      "postgresql",
+			NetworkType: "private",
+			Ips:         []IpRestriction{testManualIp},
+		})
+
+		mgr, err := ctrl.NewManager(cfg, ctrl.Options{
+			Scheme:  scheme.Scheme,
+			Metrics: metricsserver.Options{BindAddress: "0"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		reconciler := &DatabaseReconciler{
+			Client:    mgr.GetClient(),
+			APIReader: mgr.GetAPIReader(),
+			Scheme:    mgr.GetScheme(),
+			Recorder:  mgr.GetEventRecorderFor("database-controller"),
+			OvhClient: ovhApi,
+		}
+		Expect(reconciler.SetupWithManager(mgr)).To(Succeed())
+
+		go func() {
+			defer GinkgoRecover()
+			Expect(mgr.Start(ctx)).To(Succeed())
+		}()
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	// createNode creates the node, then sets its addresses which are dropped on creation with the rest of the status
+	createNode := func(name string, ip string) *corev1.Node {
+		node := newTestNode(name, ip, map[string]string{"nodepool": "db-clients"})
+		node.UID = ""
+		status := node.Status
+		Expect(k8sClient.Create(ctx, node)).To(Succeed())
+		node.Status = status
+		Expect(k8sClient.Status().Update(ctx, node)).To(Succeed())
+		DeferCleanup(func() {
+			Expect(client.IgnoreNotFound(k8sClient.Delete(context.Background(), node))).To(Succeed())
+		})
+		return node
+	}
+
+	serviceIps := func() []string {
+		cluster, _ := ovhApi.Service(testProjectId, testServiceId)
+		ips := []string{}
+		for _, ip := range cluster.Ips {
+			ips = append(ips, ip.IP)
+		}
+		return ips
+	}
+
+	It("authorizes the selected nodes until the Database is deleted", func() {
+		createNode("node-1", "10.0.0.1")
+		database := newTestDatabase(&metav1.LabelSelector{MatchLabels: map[string]string{"nodepool": "db-clients"}})
+		database.UID = ""
+		Expect(k8sClient.Create(ctx, database)).To(Succeed())
+
+		By("adding the ip of the node and reporting it in the status")
+		Eventually(func(g Gomega) {
+			g.Expect(serviceIps()).To(Equal([]string{testManualIp.IP, "10.0.0.1/32"}))
+			got := &v1alpha1.Database{}
+			g.Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(database), got)).To(Succeed())
+			g.Expect(got.Finalizers).To(ContainElement(databaseFinalizer))
+			g.Expect(meta.IsStatusConditionTrue(got.Status.Conditions, v1alpha1.ConditionReady)).To(BeTrue())
+			g.Expect(got.Status.Services).To(HaveLen(1))
+			g.Expect(got.Status.Services[0].AuthorizedIps).To(ConsistOf("10.0.0.1/32"))
+		}).Should(Succeed())
+
+		By("adding the ip of a new node")
+		createNode("node-2", "10.0.0.2")
+		Eventually(serviceIps).Should(ConsistOf(testManualIp.IP, "10.0.0.1/32", "10.0.0.2/32"))
+
+		By("revoking the ips of the nodes once deleted")
+		Expect(k8sClient.Delete(ctx, database)).To(Succeed())
+		Eventually(func(g Gomega) {
+			err := k8sClient.Get(ctx, client.ObjectKeyFromObject(database), &v1alpha1.Database{})
+			g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		}).Should(Succeed())
+		Expect(serviceIps()).To(Equal([]string{testManualIp.IP}))
+	})
+})
@@ -0,0 +1,112 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/ovh/public-cloud-databases-operator/api/v1alpha1"
+)
+
+// Reasons used in the conditions of the Database status
+const (
+	reasonSynced          = "Synced"
+	reasonSyncFailed      = "SyncFailed"
+	reasonApiReachable    = "ApiReachable"
+	reasonApiUnreachable  = "ApiUnreachable"
+	reasonApiError        = "ApiError"
+	reasonApiTransient    = "ApiTransientError"
+	reasonInvalidSelector = "InvalidLabelSelector"
+	reasonProbePending    = "EgressProbePending"
+	reasonCredentials     = "InvalidCredentials"
+	reasonDryRun          = "DryRun"
+	reasonBlocked         = "Blocked"
+	reasonConflict        = "ConcurrentChange"
+)
+
+// setCondition sets the condition on the crd for its current generation
+func setCondition(crd *v1alpha1.Database, conditionType string, status metav1.ConditionStatus, reason string, message string) {
+	meta.SetStatusCondition(&crd.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: crd.Generation,
+	})
+}
+
+// setSyncConditions updates the conditions of the crd according to the result of the sync
+func setSyncConditions(crd *v1alpha1.Database, err error) {
+	if err == nil {
+		setCondition(crd, v1alpha1.ConditionOvhApiReachable, metav1.ConditionTrue, reasonApiReachable, "")
+		setCondition(crd, v1alpha1.ConditionSynced, metav1.ConditionTrue, reasonSynced, "ip restrictions are up to date")
+		setCondition(crd, v1alpha1.ConditionReady, metav1.ConditionTrue, reasonSynced, "")
+		setCondition(crd, v1alpha1.ConditionBlocked, metav1.ConditionFalse, reasonNotBlocked, "")
+		return
+	}
+
+	reason := reasonSyncFailed
+	callErr := &ovhCallError{}
+	selectorErr := &invalidSelectorError{}
+	pendingErr := &egressProbePendingError{}
+	credentialsErr := &credentialsError{}
+	guardErr := &safetyGuardError{}
+	conflictErr := &concurrentChangeError{}
+	switch {
+	case errors.As(err, &credentialsErr):
+		reason = reasonCredentials
+	case errors.As(err, &pendingErr):
+		reason = reasonProbePending
+	case errors.As(err, &selectorErr):
+		reason = reasonInvalidSelector
+	case errors.As(err, &guardErr):
+		reason = reasonBlocked
+		setCondition(crd, v1alpha1.ConditionBlocked, metav1.ConditionTrue, guardErr.reason, guardErr.message)
+	case errors.As(err, &conflictErr):
+		reason = reasonConflict
+	case IsApiUnreachable(err):
+		reason = reasonApiUnreachable
+		setCondition(crd, v1alpha1.ConditionOvhApiReachable, metav1.ConditionFalse, reasonApiUnreachable, err.Error())
+	case errors.As(err, &callErr) && IsTransient(err):
+		reason = reasonApiTransient
+		setCondition(crd, v1alpha1.ConditionOvhApiReachable, metav1.ConditionTrue, reasonApiReachable, "")
+	case errors.As(err, &callErr):
+		reason = reasonApiError
+		setCondition(crd, v1alpha1.ConditionOvhApiReachable, metav1.ConditionTrue, reasonApiReachable, "")
+	}
+	setCondition(crd, v1alpha1.ConditionSynced, metav1.ConditionFalse, reason, err.Error())
+	setCondition(crd, v1alpha1.ConditionReady, metav1.ConditionFalse, reason, err.Error())
+}
+
+// setDryRunConditions reports the changes planned in dry run, which leave the services out of sync
+func setDryRunConditions(crd *v1alpha1.Database) {
+	planned := 0
+	for _, service := range crd.Status.Services {
+		planned += len(service.PlannedAdditions) + len(service.PlannedRemovals)
+	}
+	if planned == 0 {
+		return
+	}
+	message := fmt.Sprintf("dry run, %d planned changes of the ip restrictions are not applied", planned)
+	setCondition(crd, v1alpha1.ConditionSynced, metav1.ConditionFalse, reasonDryRun, message)
+	setCondition(crd, v1alpha1.ConditionReady, metav1.ConditionFalse, reasonDryRun, message)
+	setCondition(crd, v1alpha1.ConditionApplied, metav1.ConditionFalse, reasonDryRun, message)
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strings"
+)
+
+// IpRestrictionsDiff is the set of changes between two ip restrictions lists
+type IpRestrictionsDiff struct {
+	Added   []IpRestriction
+	Removed []IpRestriction
+}
+
+// DiffIpRestrictions compares the current and desired ip restrictions regardless of their order
+func DiffIpRestrictions(current []IpRestriction, desired []IpRestriction) IpRestrictionsDiff {
+	currentSet := make(map[IpRestriction]struct{}, len(current))
+	for _, ip := range current {
+		currentSet[ip] = struct{}{}
+	}
+	desiredSet := make(map[IpRestriction]struct{}, len(desired))
+	for _, ip := range desired {
+		desiredSet[ip] = struct{}{}
+	}
+
+	diff := IpRestrictionsDiff{}
+	for _, ip := range desired {
+		if _, exist := currentSet[ip]; !exist {
+			diff.Added = append(diff.Added, ip)
+			// the same entry can not be added twice
+			currentSet[ip] = struct{}{}
+		}
+	}
+	for _, ip := range current {
+		if _, exist := desiredSet[ip]; !exist {
+			diff.Removed = append(diff.Removed, ip)
+			desiredSet[ip] = struct{}{}
+		}
+	}
+	return diff
+}
+
+// IsEmpty checks if there is no change
+func (d IpRestrictionsDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0
+}
+
+func (d IpRestrictionsDiff) String() string {
+	return "added [" + joinIps(d.Added) + "], removed [" + joinIps(d.Removed) + "]"
+}
+
+func joinIps(ips []IpRestriction) string {
+	return strings.Join(ipsOf(ips), ", ")
+}
+
+// ipsOf returns the ips of the ip restrictions
+func ipsOf(ips []IpRestriction) []string {
+	values := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		values = append(values, ip.IP)
+	}
+	return values
+}
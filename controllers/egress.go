@@ -0,0 +1,236 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/ovh/public-cloud-databases-operator/api/v1alpha1"
+)
+
+const (
+	DefaultEgressEchoURL    = "https://ifconfig.io"
+	DefaultEgressAnnotation = "cloud.ovh.net/egress-ips"
+	DefaultEgressTimeout    = 10 * time.Second
+
+	// maxEchoResponseSize bounds the answer read from the echo service, which only holds an ip
+	maxEchoResponseSize = 256
+)
+
+// EgressDiscoveryConfig is the operator wide configuration of the egress IPs discovery,
+// each field can be overridden by the spec of the crd
+type EgressDiscoveryConfig struct {
+	Mode       string
+	EchoURL    string
+	StaticIps  []string
+	Annotation string
+	Timeout    time.Duration
+
+	// Probe mode settings, only configurable on the operator
+	ProbeNamespace   string
+	ProbeImage       string
+	ProbeGroupLabels []string
+	ProbeTTL         time.Duration
+}
+
+// egressDiscovery merges the egress discovery of the crd with the operator defaults
+func (r *DatabaseReconciler) egressDiscovery(crd v1alpha1.Database) (EgressDiscoveryConfig, string) {
+	config := r.EgressDiscovery
+	if config.Mode == "" {
+		config.Mode = v1alpha1.EgressDiscoveryEcho
+	}
+	if config.EchoURL == "" {
+		config.EchoURL = DefaultEgressEchoURL
+	}
+	if config.Annotation == "" {
+		config.Annotation = DefaultEgressAnnotation
+	}
+	if config.Timeout == 0 {
+		config.Timeout = DefaultEgressTimeout
+	}
+	if config.ProbeNamespace == "" {
+		config.ProbeNamespace = DefaultEgressProbeNamespace
+	}
+	if config.ProbeImage == "" {
+		config.ProbeImage = DefaultEgressProbeImage
+	}
+	if len(config.ProbeGroupLabels) == 0 {
+		config.ProbeGroupLabels = DefaultEgressProbeGroupLabels
+	}
+	if config.ProbeTTL == 0 {
+		config.ProbeTTL = DefaultEgressProbeTTL
+	}
+
+	spec := crd.Spec.EgressDiscovery
+	if spec == nil {
+		return config, ""
+	}
+	if spec.Mode != "" {
+		config.Mode = spec.Mode
+	}
+	if spec.EchoURL != "" {
+		config.EchoURL = spec.EchoURL
+	}
+	if len(spec.StaticIps) > 0 {
+		config.StaticIps = spec.StaticIps
+	}
+	if spec.Annotation != "" {
+		config.Annotation = spec.Annotation
+	}
+	if spec.Timeout != nil {
+		config.Timeout = spec.Timeout.Duration
+	}
+	return config, spec.ServiceName
+}
+
+// discoverEgressIps returns the egress IPs of the cluster according to the egress discovery of the crd
+func (r *DatabaseReconciler) discoverEgressIps(ctx context.Context, crd v1alpha1.Database, nodes corev1.NodeList) (*v1alpha1.EgressStatus, error) {
+	logger := log.FromContext(ctx)
+	config, serviceName := r.egressDiscovery(crd)
+	egress := &v1alpha1.EgressStatus{Mode: config.Mode}
+
+	var ips []string
+	var err error
+	switch config.Mode {
+	case v1alpha1.EgressDiscoveryDisabled:
+		return egress, nil
+	case v1alpha1.EgressDiscoveryEcho:
+		ips, err = echoEgressIps(ctx, config)
+	case v1alpha1.EgressDiscoveryProbe:
+		egress.Groups, err = r.probeEgressIps(ctx, config, nodes)
+		ips = distinctEgressIps(egress.Groups)
+	case v1alpha1.EgressDiscoveryStatic:
+		ips = config.StaticIps
+	case v1alpha1.EgressDiscoveryAnnotation:
+		ips, err = r.annotationEgressIps(ctx, crd.Namespace, serviceName, config.Annotation, nodes)
+	default:
+		err = fmt.Errorf("unknown egress discovery mode %q", config.Mode)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover egress ips: %w", err)
+	}
+
+	for _, ip := range ips {
+		addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+		if err != nil {
+			return nil, fmt.Errorf("invalid egress ip %q: %w", ip, err)
+		}
+		egress.Ips = append(egress.Ips, addr.Unmap().String())
+	}
+	logger.V(1).Info(fmt.Sprintf("Egress IPs (%s): %v", config.Mode, egress.Ips))
+	return egress, nil
+}
+
+// distinctEgressIps returns the distinct ips found by the probes of the groups
+func distinctEgressIps(groups []v1alpha1.EgressGroup) []string {
+	ipsMap := make(map[string]struct{})
+	ips := []string{}
+	for _, group := range groups {
+		if _, exist := ipsMap[group.Ip]; !exist {
+			ipsMap[group.Ip] = struct{}{}
+			ips = append(ips, group.Ip)
+		}
+	}
+	return ips
+}
+
+// echoEgressIps gets the egress ip used from the cluster (the operator is inside the cluster)
+func echoEgressIps(ctx context.Context, config EgressDiscoveryConfig) ([]string, error) {
+	if err := validateEchoURL(config.EchoURL); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, config.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, config.EchoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered with status %d", config.EchoURL, res.StatusCode)
+	}
+
+	// the answer is not reported, the url may be any endpoint reachable from the operator
+	resBody, err := io.ReadAll(io.LimitReader(res.Body, maxEchoResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	addr, err := netip.ParseAddr(strings.TrimSpace(string(resBody)))
+	if err != nil {
+		return nil, fmt.Errorf("%s did not answer with an ip", config.EchoURL)
+	}
+	return []string{addr.String()}, nil
+}
+
+// validateEchoURL checks that the echo url is an http or https url
+func validateEchoURL(echoURL string) error {
+	u, err := url.Parse(echoURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid echo url %q, an http or https url is expected", echoURL)
+	}
+	return nil
+}
+
+// annotationEgressIps reads the egress ips from the annotation of the service if set, otherwise from the nodes
+func (r *DatabaseReconciler) annotationEgressIps(ctx context.Context, namespace string, serviceName string, annotation string, nodes corev1.NodeList) ([]string, error) {
+	if serviceName != "" {
+		// the services are not watched, a single one is read from the api server
+		service := corev1.Service{}
+		if err := r.apiReader().Get(ctx, types.NamespacedName{Namespace: namespace, Name: serviceName}, &service); err != nil {
+			return nil, err
+		}
+		return splitIps(service.Annotations[annotation]), nil
+	}
+
+	ipsMap := make(map[string]struct{})
+	ips := []string{}
+	for _, node := range nodes.Items {
+		for _, ip := range splitIps(node.Annotations[annotation]) {
+			if _, exist := ipsMap[ip]; !exist {
+				ipsMap[ip] = struct{}{}
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips, nil
+}
+
+func splitIps(value string) []string {
+	ips := []string{}
+	for _, ip := range strings.Split(value, ",") {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
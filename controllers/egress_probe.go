@@ -0,0 +1,260 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/ovh/public-cloud-databases-operator/api/v1alpha1"
+)
+
+const (
+	DefaultEgressProbeImage     = "curlimages/curl:8.10.1"
+	DefaultEgressProbeNamespace = "default"
+	DefaultEgressProbeTTL       = time.Hour
+
+	// EgressProbeLabel is set on the probe pods, its value is the hash of the probed node group and echo url
+	EgressProbeLabel = "cloud.ovh.net/egress-probe"
+
+	// egressProbePollInterval is the delay before checking again a running probe
+	egressProbePollInterval = 5 * time.Second
+)
+
+// DefaultEgressProbeGroupLabels are the node labels used to group the nodes sharing the same egress
+var DefaultEgressProbeGroupLabels = []string{"topology.kubernetes.io/zone", "nodepool"}
+
+// egressProbePendingError is returned while the egress probes are still running
+type egressProbePendingError struct {
+	pending int
+}
+
+func (e *egressProbePendingError) Error() string {
+	return fmt.Sprintf("waiting for %d egress probes to complete", e.pending)
+}
+
+// egressProbeCache holds the egress ip found by the probes of each node group and echo url
+type egressProbeCache struct {
+	mu      sync.Mutex
+	results map[string]egressProbeResult
+}
+
+type egressProbeResult struct {
+	ip      string
+	expires time.Time
+}
+
+func (c *egressProbeCache) get(probe string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result, ok := c.results[probe]
+	if !ok || time.Now().After(result.expires) {
+		return "", false
+	}
+	return result.ip, true
+}
+
+func (c *egressProbeCache) set(probe string, ip string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.results == nil {
+		c.results = map[string]egressProbeResult{}
+	}
+	c.results[probe] = egressProbeResult{ip: ip, expires: time.Now().Add(ttl)}
+}
+
+// probeEgressIps runs a probe pod on one node of each group of the selected nodes to learn
+// the egress ip of the group. The results are cached, and an egressProbePendingError is
+// returned until all the probes have completed.
+func (r *DatabaseReconciler) probeEgressIps(ctx context.Context, config EgressDiscoveryConfig, nodes corev1.NodeList) ([]v1alpha1.EgressGroup, error) {
+	logger := log.FromContext(ctx)
+	if err := validateEchoURL(config.EchoURL); err != nil {
+		return nil, err
+	}
+	groups := groupNodes(nodes, config.ProbeGroupLabels)
+
+	egressGroups := []v1alpha1.EgressGroup{}
+	pending := 0
+	for _, group := range sortedKeys(groups) {
+		// the echo url may be set by the crd, the results of the other urls are not trusted
+		probe := egressProbeKey(group, config.EchoURL)
+		ip, ok := r.egressProbes.get(probe)
+		if !ok {
+			var err error
+			ip, err = r.runEgressProbe(ctx, config, probe, group, groups[group])
+			if err != nil {
+				return nil, err
+			}
+			if ip == "" {
+				pending++
+				continue
+			}
+			logger.V(1).Info(fmt.Sprintf("egress probe of %s: %s", group, ip))
+			r.egressProbes.set(probe, ip, config.ProbeTTL)
+		}
+		egressGroups = append(egressGroups, v1alpha1.EgressGroup{Name: group, Ip: ip})
+	}
+	if pending > 0 {
+		return nil, &egressProbePendingError{pending: pending}
+	}
+	return egressGroups, nil
+}
+
+// runEgressProbe creates the probe pod of the group if needed, and returns the ip it found once completed
+func (r *DatabaseReconciler) runEgressProbe(ctx context.Context, config EgressDiscoveryConfig, probe string, group string, node corev1.Node) (string, error) {
+	pod := corev1.Pod{}
+	key := types.NamespacedName{Namespace: config.ProbeNamespace, Name: egressProbeName(probe)}
+	err := r.Get(ctx, key, &pod)
+	if apierrors.IsNotFound(err) {
+		err := r.Create(ctx, newEgressProbePod(config, key, group, node))
+		if apierrors.IsAlreadyExists(err) {
+			// created meanwhile by the reconcile of another crd probing the same group, not yet in the cache
+			return "", nil
+		}
+		return "", err
+	}
+	if err != nil {
+		return "", err
+	}
+
+	switch pod.Status.Phase {
+	case corev1.PodSucceeded:
+		if err := r.Delete(ctx, &pod); client.IgnoreNotFound(err) != nil {
+			return "", err
+		}
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.State.Terminated != nil {
+				// the answer is not reported, the url may be any endpoint reachable from the node
+				addr, err := netip.ParseAddr(strings.TrimSpace(status.State.Terminated.Message))
+				if err != nil {
+					return "", fmt.Errorf("egress probe %s did not get an ip from %s", key.Name, config.EchoURL)
+				}
+				return addr.Unmap().String(), nil
+			}
+		}
+		return "", fmt.Errorf("egress probe %s has no result", key.Name)
+	case corev1.PodFailed:
+		if err := r.Delete(ctx, &pod); client.IgnoreNotFound(err) != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("egress probe %s on node %s failed: %s", key.Name, pod.Spec.NodeName, pod.Status.Message)
+	}
+	return "", nil
+}
+
+func newEgressProbePod(config EgressDiscoveryConfig, key types.NamespacedName, group string, node corev1.Node) *corev1.Pod {
+	deadline := int64(config.Timeout.Seconds()) + 60
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      key.Name,
+			Namespace: key.Namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/managed-by": "public-cloud-databases-operator",
+				EgressProbeLabel:               key.Name,
+			},
+			Annotations: map[string]string{EgressProbeLabel: group},
+		},
+		Spec: corev1.PodSpec{
+			// pin the pod on the node, bypassing the scheduler and its taints
+			NodeName:              node.Name,
+			RestartPolicy:         corev1.RestartPolicyNever,
+			ActiveDeadlineSeconds: &deadline,
+			Tolerations:           []corev1.Toleration{{Operator: corev1.TolerationOpExists}},
+			Containers: []corev1.Container{
+				{
+					Name:  "probe",
+					Image: config.ProbeImage,
+					// the answer is written in the termination message so it can be read from the pod status,
+					// the url is passed as is to curl, without shell
+					Command: []string{"curl", "-fsS", "--max-time", strconv.Itoa(int(config.Timeout.Seconds())),
+						"-o", "/dev/termination-log", config.EchoURL},
+				},
+			},
+		},
+	}
+}
+
+// groupNodes returns one node for each distinct value of the group labels
+func groupNodes(nodes corev1.NodeList, groupLabels []string) map[string]corev1.Node {
+	groups := make(map[string]corev1.Node)
+	for _, node := range nodes.Items {
+		values := make([]string, 0, len(groupLabels))
+		for _, label := range groupLabels {
+			values = append(values, fmt.Sprintf("%s=%s", label, node.Labels[label]))
+		}
+		group := strings.Join(values, ",")
+		if _, exist := groups[group]; !exist {
+			groups[group] = node
+		}
+	}
+	return groups
+}
+
+// inEgressGroup checks if the node has the label values of the group, named after them by groupNodes
+func inEgressGroup(node corev1.Node, group string) bool {
+	for _, value := range strings.Split(group, ",") {
+		label, value, _ := strings.Cut(value, "=")
+		if node.Labels[label] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// egressGroupOf returns the probed group of the node, nil if the egress was not probed
+func egressGroupOf(egress v1alpha1.EgressStatus, node corev1.Node) *v1alpha1.EgressGroup {
+	for i := range egress.Groups {
+		if inEgressGroup(node, egress.Groups[i].Name) {
+			return &egress.Groups[i]
+		}
+	}
+	return nil
+}
+
+// egressProbeKey identifies the probes of the group requesting the echo url
+func egressProbeKey(group string, echoURL string) string {
+	return group + " " + echoURL
+}
+
+func egressProbeName(probe string) string {
+	hash := sha256.Sum256([]byte(probe))
+	return "egress-probe-" + hex.EncodeToString(hash[:])[:10]
+}
+
+func sortedKeys(m map[string]corev1.Node) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
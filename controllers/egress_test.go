@@ -0,0 +1,66 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEchoEgressIps(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/ip" {
+			fmt.Fprintln(w, "198.51.100.1")
+			return
+		}
+		fmt.Fprint(w, "secret-token "+strings.Repeat("x", 2*maxEchoResponseSize))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		url     string
+		want    string
+		wantErr bool
+	}{
+		{url: server.URL + "/ip", want: "198.51.100.1"},
+		{url: server.URL + "/metadata", wantErr: true},
+		{url: "file:///etc/passwd", wantErr: true},
+		{url: "ifconfig.io", wantErr: true},
+	}
+	for _, tt := range tests {
+		ips, err := echoEgressIps(context.Background(), EgressDiscoveryConfig{EchoURL: tt.url, Timeout: time.Second})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("echoEgressIps(%q) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			// the answer of the url must not be reported
+			if strings.Contains(err.Error(), "secret-token") {
+				t.Errorf("echoEgressIps(%q) error reports the answer: %v", tt.url, err)
+			}
+			continue
+		}
+		if len(ips) != 1 || ips[0] != tt.want {
+			t.Errorf("echoEgressIps(%q) = %v, want %q", tt.url, ips, tt.want)
+		}
+	}
+}
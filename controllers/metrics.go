@@ -0,0 +1,163 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/ovh/go-ovh/ovh"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/ovh/public-cloud-databases-operator/api/v1alpha1"
+)
+
+const metricsNamespace = "public_cloud_databases_operator"
+
+// OperatorCredentials is the credentials label of the metrics about the credentials of the operator,
+// the metrics about the credentials Secrets are labeled with the namespace/name of the Secret
+const OperatorCredentials = "operator"
+
+var (
+	ovhAuthMode = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "ovh_auth_mode",
+		Help:      "Authentication mode of the OVHcloud api clients, 1 for the mode in use.",
+	}, []string{"credentials", "mode"})
+
+	ovhApiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ovh_api_requests_total",
+		Help:      "Number of calls to the OVHcloud api by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	ovhApiRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "ovh_api_request_duration_seconds",
+		Help:      "Latency of the calls to the OVHcloud api by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	ipRestrictionChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ip_restriction_changes_total",
+		Help:      "Number of ip restrictions added or removed on a service by the operator.",
+	}, []string{"project_id", "service_id", "change"})
+
+	ipRestrictionConflicts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ip_restriction_conflicts_total",
+		Help:      "Number of updates of a service aborted because its ip restrictions were changed concurrently.",
+	}, []string{"project_id", "service_id"})
+
+	authorizedIpsCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "authorized_ips",
+		Help:      "Number of ips authorized by the operator on a service for a Database.",
+	}, []string{"namespace", "name", "project_id", "service_id"})
+
+	egressDiscoveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "egress_discoveries_total",
+		Help:      "Number of egress ips discoveries by mode and result.",
+	}, []string{"mode", "result"})
+
+	lastSyncTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "database_last_sync_timestamp_seconds",
+		Help:      "Timestamp of the last successful sync of a Database.",
+	}, []string{"namespace", "name"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		ovhAuthMode,
+		ovhApiRequests,
+		ovhApiRequestDuration,
+		ipRestrictionChanges,
+		ipRestrictionConflicts,
+		authorizedIpsCount,
+		egressDiscoveries,
+		lastSyncTimestamp,
+	)
+}
+
+// SetOperatorAuthModeMetric reports the authentication mode of the credentials of the operator
+func SetOperatorAuthModeMetric(mode string) {
+	setAuthModeMetric(OperatorCredentials, mode)
+}
+
+func setAuthModeMetric(credentials string, mode string) {
+	ovhAuthMode.DeletePartialMatch(prometheus.Labels{"credentials": credentials})
+	ovhAuthMode.WithLabelValues(credentials, mode).Set(1)
+}
+
+// observeOvhApiCall records a call to the api, the status is the code of the api error if any,
+// "error" when no answer was received
+func observeOvhApiCall(method string, route string, duration time.Duration, err error) {
+	status := "2xx"
+	if err != nil {
+		status = "error"
+		apiErr := &ovh.APIError{}
+		if errors.As(err, &apiErr) {
+			status = strconv.Itoa(apiErr.Code)
+		}
+	}
+	ovhApiRequests.WithLabelValues(route, method, status).Inc()
+	ovhApiRequestDuration.WithLabelValues(route, method).Observe(duration.Seconds())
+}
+
+// observeIpRestrictionChanges records the ip restrictions added and removed on a service
+func observeIpRestrictionChanges(projectId string, serviceId string, diff IpRestrictionsDiff) {
+	ipRestrictionChanges.WithLabelValues(projectId, serviceId, "added").Add(float64(len(diff.Added)))
+	ipRestrictionChanges.WithLabelValues(projectId, serviceId, "removed").Add(float64(len(diff.Removed)))
+}
+
+// observeIpRestrictionConflict records an update of a service aborted because of a concurrent change
+func observeIpRestrictionConflict(projectId string, serviceId string) {
+	ipRestrictionConflicts.WithLabelValues(projectId, serviceId).Inc()
+}
+
+// observeEgressDiscovery records the result of an egress ips discovery
+func observeEgressDiscovery(mode string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	egressDiscoveries.WithLabelValues(mode, result).Inc()
+}
+
+// setDatabaseMetrics reports the ips authorized on the services of the crd and its last sync,
+// the Databases sharing a service each report their own ips
+func setDatabaseMetrics(crd v1alpha1.Database) {
+	// the crd may no longer target some services
+	authorizedIpsCount.DeletePartialMatch(prometheus.Labels{"namespace": crd.Namespace, "name": crd.Name})
+	for _, service := range crd.Status.Services {
+		authorizedIpsCount.WithLabelValues(crd.Namespace, crd.Name, crd.Spec.ProjectId, service.ServiceId).Set(float64(len(service.AuthorizedIps)))
+	}
+	if crd.Status.LastSyncTime != nil {
+		lastSyncTimestamp.WithLabelValues(crd.Namespace, crd.Name).Set(float64(crd.Status.LastSyncTime.Unix()))
+	}
+}
+
+// deleteDatabaseMetrics removes the metrics of the crd once deleted
+func deleteDatabaseMetrics(crd v1alpha1.Database) {
+	authorizedIpsCount.DeletePartialMatch(prometheus.Labels{"namespace": crd.Namespace, "name": crd.Name})
+	lastSyncTimestamp.DeleteLabelValues(crd.Namespace, crd.Name)
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/ovh/public-cloud-databases-operator/api/v1alpha1"
+)
+
+const (
+	DefaultNodeTaintKey = "cloud.ovh.net/database-access"
+
+	// NodeTaintModeAdd taints the selected nodes until they are authorized
+	NodeTaintModeAdd = "add"
+	// NodeTaintModeRemove only removes the taint set on the nodes at their creation, by their node pool
+	NodeTaintModeRemove = "remove"
+)
+
+// NodeTaintsConfig is the configuration of the NoSchedule taint keeping the workloads away from
+// the nodes not yet authorized on the services of the Databases selecting them
+type NodeTaintsConfig struct {
+	// Mode is NodeTaintModeAdd or NodeTaintModeRemove, the taints are not managed when empty
+	Mode string
+	// Key of the taint, DefaultNodeTaintKey by default
+	Key string
+}
+
+func (c NodeTaintsConfig) taint() corev1.Taint {
+	key := c.Key
+	if key == "" {
+		key = DefaultNodeTaintKey
+	}
+	return corev1.Taint{Key: key, Effect: corev1.TaintEffectNoSchedule}
+}
+
+// syncNodeTaints lifts the taint of the nodes selected by the crd once they are authorized on the services
+// of all the live Databases selecting them, and taints the other ones in NodeTaintModeAdd
+func (r *DatabaseReconciler) syncNodeTaints(ctx context.Context, crd v1alpha1.Database) error {
+	if r.NodeTaints.Mode == "" {
+		return nil
+	}
+	selector, err := NodeSelector(crd)
+	if err != nil {
+		// reported by the sync
+		return nil
+	}
+	nodes := corev1.NodeList{}
+	if err := r.List(ctx, &nodes, client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return fmt.Errorf("failed to list nodes: %w", err)
+	}
+	databases := v1alpha1.DatabaseList{}
+	if err := r.List(ctx, &databases); err != nil {
+		return fmt.Errorf("failed to list databases: %w", err)
+	}
+	// the status of the crd is fresher than the one in the cache
+	for i := range databases.Items {
+		if databases.Items[i].UID == crd.UID {
+			databases.Items[i] = crd
+		}
+	}
+
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		authorized, err := r.nodeAuthorized(ctx, databases.Items, *node)
+		if err != nil {
+			return err
+		}
+		if err := r.setNodeTaint(ctx, node, !authorized); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nodeAuthorized checks if the node is authorized on the services of all the Databases selecting it,
+// the Databases being deleted or in dry run excluded
+func (r *DatabaseReconciler) nodeAuthorized(ctx context.Context, databases []v1alpha1.Database, node corev1.Node) (bool, error) {
+	for _, crd := range databases {
+		if !crd.DeletionTimestamp.IsZero() || r.dryRun(crd) {
+			continue
+		}
+		selector, err := NodeSelector(crd)
+		if err != nil || !selector.Matches(labels.Set(node.Labels)) {
+			continue
+		}
+		authorized, err := nodeAuthorizedBy(ctx, r.ClusterName, crd, node)
+		if err != nil || !authorized {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// nodeAuthorizedBy checks if the ips of the node are active on all the services of the crd, as last synced
+// by the operator of the cluster. Only the ip states are considered: a failed sync keeps the states of the
+// last successful one, so that an api error does not take their access away from the nodes.
+func nodeAuthorizedBy(ctx context.Context, cluster string, crd v1alpha1.Database, node corev1.Node) (bool, error) {
+	return nodeIpsMatch(ctx, cluster, crd, node, ipsReady)
+}
+
+// nodeIpsMatch checks the ips of the node on all the services of the crd, with the ip states of its last successful sync
+func nodeIpsMatch(ctx context.Context, cluster string, crd v1alpha1.Database, node corev1.Node, match func(v1alpha1.ServiceStatus, []string) bool) (bool, error) {
+	if neverSynced(crd) {
+		// no ip is authorized yet
+		return false, nil
+	}
+	for _, service := range crd.Status.Services {
+		ips, err := nodeIps(ctx, cluster, crd, node, service.NetworkType)
+		if err != nil || !match(service, ips) {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// nodeIps returns the ips authorizing the node on a service of the given network type for the crd.
+// Behind an egress gateway, the nodes reach the public services with the ips of the gateway.
+func nodeIps(ctx context.Context, cluster string, crd v1alpha1.Database, node corev1.Node, networkType string) ([]string, error) {
+	nodes := corev1.NodeList{Items: []corev1.Node{node}}
+	internal, err := getKubeInternalAddress(ctx, cluster, nodes, crd)
+	if err != nil || networkType != "public" {
+		return ipsOf(internal), err
+	}
+	if egress := crd.Status.Egress; egress != nil && egress.Gateway {
+		gatewayIps := egress.Ips
+		// in Probe mode, the node egresses with the ip found by the probe of its group, which may be its own
+		if group := egressGroupOf(*egress, node); group != nil {
+			gatewayIps = []string{group.Ip}
+			if !group.Gateway {
+				gatewayIps = nil
+			}
+		}
+		if len(gatewayIps) > 0 {
+			gateway, err := getKubePublicAddesses(ctx, cluster, corev1.NodeList{}, crd, nil, &v1alpha1.EgressStatus{Ips: gatewayIps})
+			return ipsOf(gateway), err
+		}
+	}
+	public, err := getKubePublicAddesses(ctx, cluster, nodes, crd, internal, &v1alpha1.EgressStatus{})
+	return ipsOf(public), err
+}
+
+// ipsReady checks if all the ips are active on the service, a node without ip is not authorized
+func ipsReady(service v1alpha1.ServiceStatus, ips []string) bool {
+	if len(ips) == 0 {
+		return false
+	}
+	states := make(map[string]string, len(service.IpStates))
+	for _, ip := range service.IpStates {
+		states[ip.Ip] = ip.State
+	}
+	for _, ip := range ips {
+		if states[ip] != IpStateReady {
+			return false
+		}
+	}
+	return true
+}
+
+// setNodeTaint adds or removes the taint of the node, the taint is only added in NodeTaintModeAdd
+func (r *DatabaseReconciler) setNodeTaint(ctx context.Context, node *corev1.Node, tainted bool) error {
+	taint := r.NodeTaints.taint()
+	index := -1
+	for i := range node.Spec.Taints {
+		if node.Spec.Taints[i].MatchTaint(&taint) {
+			index = i
+			break
+		}
+	}
+	if tainted == (index >= 0) || (tainted && r.NodeTaints.Mode != NodeTaintModeAdd) {
+		return nil
+	}
+
+	patch := client.MergeFromWithOptions(node.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	if tainted {
+		log.FromContext(ctx).Info("tainting node until authorized", "node", node.Name, "taint", taint.Key)
+		node.Spec.Taints = append(node.Spec.Taints, taint)
+	} else {
+		log.FromContext(ctx).Info("node authorized, removing taint", "node", node.Name, "taint", taint.Key)
+		node.Spec.Taints = append(node.Spec.Taints[:index:index], node.Spec.Taints[index+1:]...)
+	}
+	if err := r.Patch(ctx, node, patch); err != nil {
+		return fmt.Errorf("failed to update the taints of node %s: %w", node.Name, err)
+	}
+	return nil
+}
@@ -2,7 +2,14 @@ package controllers
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ovh/go-ovh/ovh"
 )
 
 type IpRestriction struct {
@@ -14,33 +21,199 @@ type Cluster struct {
 	Engine      string          `json:"engine"`
 	Ips         []IpRestriction `json:"ipRestrictions"`
 	NetworkType string          `json:"networkType"`
+	// IpStatus is the status of the ip restrictions by ip, as reported along with them
+	IpStatus map[string]string `json:"-"`
 }
 type ClusterUpdate struct {
 	Ips []IpRestriction `json:"ipRestrictions"`
 }
+type IpRestrictionUpdate struct {
+	Description string `json:"description"`
+}
+type AccessRule struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+}
+type Credential struct {
+	CredentialId int64        `json:"credentialId"`
+	Status       string       `json:"status"`
+	Expiration   *time.Time   `json:"expiration"`
+	Rules        []AccessRule `json:"rules"`
+}
+
+// UnmarshalJSON reads the status of the ip restrictions of the service, kept out of
+// the IpRestriction so that it is neither compared nor sent back to the api
+func (c *Cluster) UnmarshalJSON(data []byte) error {
+	type cluster Cluster
+	response := struct {
+		*cluster
+		Ips []struct {
+			IpRestriction
+			Status string `json:"status"`
+		} `json:"ipRestrictions"`
+	}{cluster: (*cluster)(c)}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return err
+	}
+	if response.Ips == nil {
+		return nil
+	}
+	c.Ips = make([]IpRestriction, 0, len(response.Ips))
+	c.IpStatus = make(map[string]string, len(response.Ips))
+	for _, ip := range response.Ips {
+		c.Ips = append(c.Ips, ip.IpRestriction)
+		if ip.Status != "" {
+			c.IpStatus[ip.IP] = ip.Status
+		}
+	}
+	return nil
+}
 
 const (
 	PrefixEndpoint     = "/cloud/project"
 	GetServiceEndpoint = "database/service"
-	Mask               = "/32"
+	CredentialEndpoint = "/auth/currentCredential"
+)
+
+// Routes of the api calls, as reported in the metrics
+const (
+	routeServices       = PrefixEndpoint + "/{projectId}/" + GetServiceEndpoint
+	routeService        = PrefixEndpoint + "/{projectId}/" + GetServiceEndpoint + "/{serviceId}"
+	routeEngineService  = PrefixEndpoint + "/{projectId}/database/{engine}/{serviceId}"
+	routeIpRestrictions = routeEngineService + "/ipRestriction"
+	routeIpRestriction  = routeIpRestrictions + "/{ip}"
 )
 
-func GetServicesForProjectId(ctx context.Context, r *DatabaseReconciler, projectId string) ([]string, error) {
+// OvhApi is the set of OVHcloud api calls made by the operator
+type OvhApi interface {
+	GetServicesForProjectId(ctx context.Context, projectId string) ([]string, error)
+	GetCluster(ctx context.Context, projectId string, serviceId string) (*Cluster, error)
+	UpdateClusterNodeIps(ctx context.Context, projectId string, serviceId string, engine string, ips []IpRestriction) error
+	AddIpRestriction(ctx context.Context, projectId string, serviceId string, engine string, ip IpRestriction) error
+	UpdateIpRestriction(ctx context.Context, projectId string, serviceId string, engine string, ip IpRestriction) error
+	DeleteIpRestriction(ctx context.Context, projectId string, serviceId string, engine string, ip string) error
+	GetCurrentCredential(ctx context.Context) (*Credential, error)
+}
+
+// OvhClient implements OvhApi on top of the go-ovh client
+type OvhClient struct {
+	Client *ovh.Client
+	// AuthMode is the authentication mode of the credentials of the client
+	AuthMode string
+}
+
+var _ OvhApi = &OvhClient{}
+
+func NewOvhClient(client *ovh.Client) *OvhClient {
+	return &OvhClient{Client: client}
+}
+
+func (c *OvhClient) GetServicesForProjectId(ctx context.Context, projectId string) ([]string, error) {
 	response := []string{}
 	endpoint := fmt.Sprintf("%s/%s/%s", PrefixEndpoint, projectId, GetServiceEndpoint)
 
-	return response, r.OvhClient.Get(endpoint, &response)
+	return response, c.call(ctx, http.MethodGet, routeServices, endpoint, nil, &response)
 }
 
-func GetCluster(ctx context.Context, r *DatabaseReconciler, projectId string, serviceId string) (*Cluster, error) {
+func (c *OvhClient) GetCluster(ctx context.Context, projectId string, serviceId string) (*Cluster, error) {
 	response := Cluster{}
 	endpoint := fmt.Sprintf("%s/%s/%s/%s", PrefixEndpoint, projectId, GetServiceEndpoint, serviceId)
 
-	return &response, r.OvhClient.Get(endpoint, &response)
+	return &response, c.call(ctx, http.MethodGet, routeService, endpoint, nil, &response)
 }
 
-func UpdateClusterNodeIps(ctx context.Context, r *DatabaseReconciler, projectId string, serviceId string, engine string, ips []IpRestriction) error {
+func (c *OvhClient) UpdateClusterNodeIps(ctx context.Context, projectId string, serviceId string, engine string, ips []IpRestriction) error {
 	endpoint := fmt.Sprintf("%s/%s/database/%s/%s", PrefixEndpoint, projectId, engine, serviceId)
 
-	return r.OvhClient.Put(endpoint, ClusterUpdate{Ips: ips}, nil)
+	return c.call(ctx, http.MethodPut, routeEngineService, endpoint, ClusterUpdate{Ips: ips}, nil)
+}
+
+func (c *OvhClient) AddIpRestriction(ctx context.Context, projectId string, serviceId string, engine string, ip IpRestriction) error {
+	endpoint := fmt.Sprintf("%s/%s/database/%s/%s/ipRestriction", PrefixEndpoint, projectId, engine, serviceId)
+
+	return c.call(ctx, http.MethodPost, routeIpRestrictions, endpoint, ip, nil)
+}
+
+func (c *OvhClient) UpdateIpRestriction(ctx context.Context, projectId string, serviceId string, engine string, ip IpRestriction) error {
+	endpoint := fmt.Sprintf("%s/%s/database/%s/%s/ipRestriction/%s", PrefixEndpoint, projectId, engine, serviceId, url.PathEscape(ip.IP))
+
+	return c.call(ctx, http.MethodPut, routeIpRestriction, endpoint, IpRestrictionUpdate{Description: ip.Description}, nil)
+}
+
+func (c *OvhClient) DeleteIpRestriction(ctx context.Context, projectId string, serviceId string, engine string, ip string) error {
+	endpoint := fmt.Sprintf("%s/%s/database/%s/%s/ipRestriction/%s", PrefixEndpoint, projectId, engine, serviceId, url.PathEscape(ip))
+
+	return c.call(ctx, http.MethodDelete, routeIpRestriction, endpoint, nil, nil)
+}
+
+func (c *OvhClient) GetCurrentCredential(ctx context.Context) (*Credential, error) {
+	response := Credential{}
+
+	return &response, c.call(ctx, http.MethodGet, CredentialEndpoint, CredentialEndpoint, nil, &response)
+}
+
+// call calls the api and records the call in the metrics, under the route without the ids
+func (c *OvhClient) call(ctx context.Context, method string, route string, endpoint string, body interface{}, response interface{}) error {
+	start := time.Now()
+	err := c.Client.CallAPIWithContext(ctx, method, endpoint, body, response, true)
+	observeOvhApiCall(method, route, time.Since(start), err)
+	return err
+}
+
+// IsNotFound checks if the error returned by the ovh api is a 404
+func IsNotFound(err error) bool {
+	apiErr := &ovh.APIError{}
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+// IsForbidden checks if the error returned by the ovh api is a 403
+func IsForbidden(err error) bool {
+	apiErr := &ovh.APIError{}
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden
+}
+
+// IsTransient checks if the error returned by the ovh api is worth retrying: the service is busy
+// applying another change (409), the api is rate limiting (429) or failing (5xx), or did not answer
+func IsTransient(err error) bool {
+	apiErr := &ovh.APIError{}
+	if !errors.As(err, &apiErr) {
+		return true
+	}
+	return apiErr.Code == http.StatusConflict ||
+		apiErr.Code == http.StatusTooManyRequests ||
+		apiErr.Code >= http.StatusInternalServerError
+}
+
+// IsUnsupported checks if the error returned by the ovh api means that the route can not be used for
+// the service: it does not exist for its engine, or the credentials are not allowed to call it
+func IsUnsupported(err error) bool {
+	apiErr := &ovh.APIError{}
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.Code == http.StatusForbidden ||
+		apiErr.Code == http.StatusNotFound ||
+		apiErr.Code == http.StatusMethodNotAllowed ||
+		apiErr.Code == http.StatusNotImplemented
+}
+
+// ovhCallError wraps an error returned by a call to the ovh api
+type ovhCallError struct {
+	op  string
+	err error
+}
+
+func (e *ovhCallError) Error() string {
+	return fmt.Sprintf("failed to %s: %v", e.op, e.err)
+}
+
+func (e *ovhCallError) Unwrap() error {
+	return e.err
+}
+
+// IsApiUnreachable checks if the error comes from a call to the ovh api that did not get any answer
+func IsApiUnreachable(err error) bool {
+	callErr := &ovhCallError{}
+	apiErr := &ovh.APIError{}
+	return errors.As(err, &callErr) && !errors.As(err, &apiErr)
 }
@@ -0,0 +1,273 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/ovh/go-ovh/ovh"
+)
+
+// Methods of the OvhApi, used to inject errors and count calls on the FakeOvhApi
+const (
+	FakeGetServicesForProjectId = "GetServicesForProjectId"
+	FakeGetCluster              = "GetCluster"
+	FakeUpdateClusterNodeIps    = "UpdateClusterNodeIps"
+	FakeGetCurrentCredential    = "GetCurrentCredential"
+	FakeAddIpRestriction        = "AddIpRestriction"
+	FakeUpdateIpRestriction     = "UpdateIpRestriction"
+	FakeDeleteIpRestriction     = "DeleteIpRestriction"
+)
+
+// FakeOvhApi is an in memory implementation of OvhApi, meant to be used by tests.
+// It holds the services of each project with their ip restrictions, and answers
+// with a 404 ovh.APIError when a project or a service does not exist. The status of the
+// ip restrictions is only the one set with AddService, the ones added afterwards have none.
+// Its credential is granted all the routes unless replaced with SetCurrentCredential.
+type FakeOvhApi struct {
+	mu         sync.Mutex
+	projects   map[string]map[string]*Cluster
+	credential Credential
+	errors     map[string][]error
+	calls      map[string]int
+	hooks      []func()
+}
+
+var _ OvhApi = &FakeOvhApi{}
+
+func NewFakeOvhApi() *FakeOvhApi {
+	return &FakeOvhApi{
+		projects: map[string]map[string]*Cluster{},
+		credential: Credential{
+			Status: CredentialStatusValidated,
+			Rules: []AccessRule{
+				{Method: http.MethodGet, Path: "/*"},
+				{Method: http.MethodPost, Path: "/*"},
+				{Method: http.MethodPut, Path: "/*"},
+				{Method: http.MethodDelete, Path: "/*"},
+			},
+		},
+		errors: map[string][]error{},
+		calls:  map[string]int{},
+	}
+}
+
+// SetCurrentCredential replaces the credential returned by GetCurrentCredential
+func (f *FakeOvhApi) SetCurrentCredential(credential Credential) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.credential = credential
+}
+
+// AddService creates or replaces the service in the project
+func (f *FakeOvhApi) AddService(projectId string, cluster Cluster) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.projects[projectId]; !ok {
+		f.projects[projectId] = map[string]*Cluster{}
+	}
+	f.projects[projectId][cluster.ID] = copyCluster(&cluster)
+}
+
+// RemoveService deletes the service from the project
+func (f *FakeOvhApi) RemoveService(projectId string, serviceId string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.projects[projectId], serviceId)
+}
+
+// Service returns a copy of the service as currently stored
+func (f *FakeOvhApi) Service(projectId string, serviceId string) (Cluster, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cluster, ok := f.projects[projectId][serviceId]
+	if !ok {
+		return Cluster{}, false
+	}
+	return *copyCluster(cluster), true
+}
+
+// InjectError makes the next call to the method return err. Errors injected several
+// times on the same method are returned in order, one per call.
+func (f *FakeOvhApi) InjectError(method string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errors[method] = append(f.errors[method], err)
+}
+
+// OnGetCluster runs the hook once, right after the next call to GetCluster returned, to simulate a change
+// made by someone else in between two calls of the operator
+func (f *FakeOvhApi) OnGetCluster(hook func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.hooks = append(f.hooks, hook)
+}
+
+func (f *FakeOvhApi) runHook() {
+	f.mu.Lock()
+	if len(f.hooks) == 0 {
+		f.mu.Unlock()
+		return
+	}
+	hook := f.hooks[0]
+	f.hooks = f.hooks[1:]
+	f.mu.Unlock()
+	hook()
+}
+
+// Calls returns the number of calls made to the method
+func (f *FakeOvhApi) Calls(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[method]
+}
+
+// call records the call to the method and returns the next injected error if any
+func (f *FakeOvhApi) call(method string) error {
+	f.calls[method]++
+	errs := f.errors[method]
+	if len(errs) == 0 {
+		return nil
+	}
+	f.errors[method] = errs[1:]
+	return errs[0]
+}
+
+func (f *FakeOvhApi) GetServicesForProjectId(ctx context.Context, projectId string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call(FakeGetServicesForProjectId); err != nil {
+		return nil, err
+	}
+	services, ok := f.projects[projectId]
+	if !ok {
+		return nil, notFound("project %s not found", projectId)
+	}
+	servicesIds := make([]string, 0, len(services))
+	for serviceId := range services {
+		servicesIds = append(servicesIds, serviceId)
+	}
+	sort.Strings(servicesIds)
+	return servicesIds, nil
+}
+
+func (f *FakeOvhApi) GetCluster(ctx context.Context, projectId string, serviceId string) (*Cluster, error) {
+	// run once the lock is released
+	defer f.runHook()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call(FakeGetCluster); err != nil {
+		return nil, err
+	}
+	cluster, ok := f.projects[projectId][serviceId]
+	if !ok {
+		return nil, notFound("service %s not found", serviceId)
+	}
+	return copyCluster(cluster), nil
+}
+
+func (f *FakeOvhApi) UpdateClusterNodeIps(ctx context.Context, projectId string, serviceId string, engine string, ips []IpRestriction) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call(FakeUpdateClusterNodeIps); err != nil {
+		return err
+	}
+	cluster, ok := f.projects[projectId][serviceId]
+	if !ok || cluster.Engine != engine {
+		return notFound("service %s not found", serviceId)
+	}
+	cluster.Ips = append([]IpRestriction{}, ips...)
+	return nil
+}
+
+func (f *FakeOvhApi) AddIpRestriction(ctx context.Context, projectId string, serviceId string, engine string, ip IpRestriction) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call(FakeAddIpRestriction); err != nil {
+		return err
+	}
+	cluster, ok := f.projects[projectId][serviceId]
+	if !ok || cluster.Engine != engine {
+		return notFound("service %s not found", serviceId)
+	}
+	if indexOfIp(cluster.Ips, ip.IP) >= 0 {
+		return &ovh.APIError{Code: http.StatusBadRequest, Class: "Client::BadRequest", Message: fmt.Sprintf("ip %s already exists", ip.IP)}
+	}
+	cluster.Ips = append(cluster.Ips, ip)
+	return nil
+}
+
+func (f *FakeOvhApi) UpdateIpRestriction(ctx context.Context, projectId string, serviceId string, engine string, ip IpRestriction) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call(FakeUpdateIpRestriction); err != nil {
+		return err
+	}
+	cluster, ok := f.projects[projectId][serviceId]
+	if !ok || cluster.Engine != engine {
+		return notFound("service %s not found", serviceId)
+	}
+	index := indexOfIp(cluster.Ips, ip.IP)
+	if index < 0 {
+		return notFound("ip %s not found", ip.IP)
+	}
+	cluster.Ips[index] = ip
+	return nil
+}
+
+func (f *FakeOvhApi) DeleteIpRestriction(ctx context.Context, projectId string, serviceId string, engine string, ip string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call(FakeDeleteIpRestriction); err != nil {
+		return err
+	}
+	cluster, ok := f.projects[projectId][serviceId]
+	if !ok || cluster.Engine != engine {
+		return notFound("service %s not found", serviceId)
+	}
+	index := indexOfIp(cluster.Ips, ip)
+	if index < 0 {
+		return notFound("ip %s not found", ip)
+	}
+	cluster.Ips = append(cluster.Ips[:index:index], cluster.Ips[index+1:]...)
+	delete(cluster.IpStatus, ip)
+	return nil
+}
+
+func (f *FakeOvhApi) GetCurrentCredential(ctx context.Context) (*Credential, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call(FakeGetCurrentCredential); err != nil {
+		return nil, err
+	}
+	credential := f.credential
+	credential.Rules = append([]AccessRule{}, f.credential.Rules...)
+	return &credential, nil
+}
+
+func indexOfIp(ips []IpRestriction, ip string) int {
+	for i := range ips {
+		if ips[i].IP == ip {
+			return i
+		}
+	}
+	return -1
+}
+
+func copyCluster(cluster *Cluster) *Cluster {
+	c := *cluster
+	c.Ips = append([]IpRestriction{}, cluster.Ips...)
+	if cluster.IpStatus != nil {
+		c.IpStatus = make(map[string]string, len(cluster.IpStatus))
+		for ip, status := range cluster.IpStatus {
+			c.IpStatus[ip] = status
+		}
+	}
+	return &c
+}
+
+func notFound(format string, args ...interface{}) error {
+	return &ovh.APIError{Code: http.StatusNotFound, Class: "Client::NotFound", Message: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestClusterUnmarshalJSON(t *testing.T) {
+	data := `{
+		"id": "service",
+		"engine": "postgresql",
+		"networkType": "private",
+		"ipRestrictions": [
+			{"ip": "10.0.0.1/32", "description": "node-1", "status": "READY"},
+			{"ip": "10.0.0.2/32", "description": "node-2", "status": "PENDING"}
+		]
+	}`
+	cluster := Cluster{}
+	if err := json.Unmarshal([]byte(data), &cluster); err != nil {
+		t.Fatal(err)
+	}
+	if cluster.ID != "service" || cluster.Engine != "postgresql" || cluster.NetworkType != "private" {
+		t.Errorf("unexpected service: %+v", cluster)
+	}
+	if len(cluster.Ips) != 2 || cluster.Ips[1] != (IpRestriction{IP: "10.0.0.2/32", Description: "node-2"}) {
+		t.Errorf("unexpected ip restrictions: %+v", cluster.Ips)
+	}
+	if cluster.IpStatus["10.0.0.1/32"] != "READY" || cluster.IpStatus["10.0.0.2/32"] != "PENDING" {
+		t.Errorf("unexpected ip status: %+v", cluster.IpStatus)
+	}
+
+	// the status is not sent back to the api
+	body, err := json.Marshal(ClusterUpdate{Ips: cluster.Ips})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"ipRestrictions":[{"ip":"10.0.0.1/32","description":"node-1"},{"ip":"10.0.0.2/32","description":"node-2"}]}`; string(body) != want {
+		t.Errorf("unexpected body: %s", body)
+	}
+}
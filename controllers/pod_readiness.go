@@ -0,0 +1,235 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"github.com/ovh/public-cloud-databases-operator/api/v1alpha1"
+)
+
+const (
+	// DatabaseAccessReadinessGate is the readiness gate of the pods waiting for their node to be authorized
+	DatabaseAccessReadinessGate corev1.PodConditionType = "cloud.ovh.net/database-access"
+	// DatabasesAnnotation is the comma separated list of the Databases of the namespace of the pod it must access
+	DatabasesAnnotation = "cloud.ovh.net/databases"
+)
+
+// Reasons of the database access condition of the pods
+const (
+	reasonAccessGranted    = "DatabaseAccessGranted"
+	reasonAccessPending    = "DatabaseAccessPending"
+	reasonDatabaseNotFound = "DatabaseNotFound"
+	reasonNoDatabase       = "NoDatabase"
+)
+
+// PodReadinessReconciler sets the condition of the DatabaseAccessReadinessGate of the pods declaring it, true once the ips
+// of their node, or of the egress gateway, are active on the services of the Databases listed in their DatabasesAnnotation
+type PodReadinessReconciler struct {
+	client.Client
+
+	// ClusterName is the name of the cluster in the descriptions of the ip restrictions, as set on the DatabaseReconciler
+	ClusterName string
+}
+
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=pods/status,verbs=get;update;patch
+
+// Reconcile sets the database access condition of the pod
+func (r *PodReadinessReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := ctrl.Log.WithName("controllers").WithName("Pod").WithValues("req", req)
+	ctx = log.IntoContext(ctx, logger)
+
+	pod := &corev1.Pod{}
+	if err := r.Get(ctx, req.NamespacedName, pod); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if !hasDatabaseAccessGate(pod) || pod.Spec.NodeName == "" || !pod.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	status, reason, message, err := r.databaseAccess(ctx, pod)
+	if err != nil {
+		logger.Error(err, "failed to check the database access")
+		return ctrl.Result{}, err
+	}
+	if err := r.setCondition(ctx, pod, status, reason, message); err != nil {
+		logger.Error(err, "failed to update pod condition")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// databaseAccess returns the status, reason and message of the database access condition of the pod
+func (r *PodReadinessReconciler) databaseAccess(ctx context.Context, pod *corev1.Pod) (corev1.ConditionStatus, string, string, error) {
+	names := podDatabases(pod)
+	if len(names) == 0 {
+		return corev1.ConditionFalse, reasonNoDatabase, fmt.Sprintf("the %s annotation lists no Database", DatabasesAnnotation), nil
+	}
+	node := &corev1.Node{}
+	if err := r.Get(ctx, client.ObjectKey{Name: pod.Spec.NodeName}, node); err != nil {
+		return "", "", "", fmt.Errorf("failed to get node %s: %w", pod.Spec.NodeName, err)
+	}
+
+	// a pod which had access keeps it until the ips of its node are removed, whatever their state
+	match := ipsReady
+	if hasDatabaseAccess(pod) {
+		match = ipsPresent
+	}
+	pending := []string{}
+	for _, name := range names {
+		crd := &v1alpha1.Database{}
+		err := r.Get(ctx, client.ObjectKey{Namespace: pod.Namespace, Name: name}, crd)
+		if apierrors.IsNotFound(err) {
+			return corev1.ConditionFalse, reasonDatabaseNotFound, fmt.Sprintf("Database %s not found", name), nil
+		}
+		if err != nil {
+			return "", "", "", fmt.Errorf("failed to get database %s: %w", name, err)
+		}
+		authorized, err := nodeIpsMatch(ctx, r.ClusterName, *crd, *node, match)
+		if err != nil {
+			return "", "", "", err
+		}
+		if !authorized {
+			pending = append(pending, name)
+		}
+	}
+	if len(pending) > 0 {
+		return corev1.ConditionFalse, reasonAccessPending, fmt.Sprintf("node %s not yet authorized by %s", node.Name, strings.Join(pending, ", ")), nil
+	}
+	return corev1.ConditionTrue, reasonAccessGranted, "", nil
+}
+
+// setCondition sets the database access condition of the pod when it changes
+func (r *PodReadinessReconciler) setCondition(ctx context.Context, pod *corev1.Pod, status corev1.ConditionStatus, reason string, message string) error {
+	condition := corev1.PodCondition{
+		Type:               DatabaseAccessReadinessGate,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		LastTransitionTime: metav1.Now(),
+	}
+	index := slices.IndexFunc(pod.Status.Conditions, func(c corev1.PodCondition) bool { return c.Type == DatabaseAccessReadinessGate })
+	patch := client.MergeFromWithOptions(pod.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	if index < 0 {
+		pod.Status.Conditions = append(pod.Status.Conditions, condition)
+	} else {
+		previous := pod.Status.Conditions[index]
+		if previous.Status == status && previous.Reason == reason && previous.Message == message {
+			return nil
+		}
+		if previous.Status == status {
+			condition.LastTransitionTime = previous.LastTransitionTime
+		}
+		pod.Status.Conditions[index] = condition
+	}
+	log.FromContext(ctx).Info("setting database access condition", "pod", pod.Name, "status", status, "reason", reason)
+	return r.Status().Patch(ctx, pod, patch)
+}
+
+// hasDatabaseAccess checks if the database access condition of the pod is true
+func hasDatabaseAccess(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == DatabaseAccessReadinessGate {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// ipsPresent checks if all the ips are still in the ip restrictions of the service, whatever their state
+func ipsPresent(service v1alpha1.ServiceStatus, ips []string) bool {
+	if len(ips) == 0 {
+		return false
+	}
+	states := make(map[string]string, len(service.IpStates))
+	for _, ip := range service.IpStates {
+		states[ip.Ip] = ip.State
+	}
+	for _, ip := range ips {
+		if state, ok := states[ip]; !ok || state == IpStateAbsent {
+			return false
+		}
+	}
+	return true
+}
+
+func hasDatabaseAccessGate(pod *corev1.Pod) bool {
+	for _, gate := range pod.Spec.ReadinessGates {
+		if gate.ConditionType == DatabaseAccessReadinessGate {
+			return true
+		}
+	}
+	return false
+}
+
+// podDatabases returns the names of the Databases listed in the annotation of the pod
+func podDatabases(pod *corev1.Pod) []string {
+	names := []string{}
+	for _, name := range strings.Split(pod.Annotations[DatabasesAnnotation], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *PodReadinessReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("pod-readiness").
+		For(&corev1.Pod{}, builder.WithPredicates(predicate.NewPredicateFuncs(func(object client.Object) bool {
+			pod, ok := object.(*corev1.Pod)
+			return ok && hasDatabaseAccessGate(pod)
+		}))).
+		// the status of the Databases tells when the nodes are authorized
+		Watches(&v1alpha1.Database{}, handler.EnqueueRequestsFromMapFunc(r.podsForDatabase)).
+		Complete(r)
+}
+
+// podsForDatabase returns a request for each pod of the namespace of the crd listing it in its annotation
+func (r *PodReadinessReconciler) podsForDatabase(ctx context.Context, object client.Object) []ctrl.Request {
+	logger := log.FromContext(ctx)
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(object.GetNamespace())); err != nil {
+		logger.Error(err, "failed to list pods")
+		return nil
+	}
+
+	reqs := []ctrl.Request{}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if hasDatabaseAccessGate(pod) && slices.Contains(podDatabases(pod), object.GetName()) {
+			reqs = append(reqs, ctrl.Request{NamespacedName: types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}})
+		}
+	}
+	return reqs
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/ovh/go-ovh/ovh"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func newTestPod(name string, nodeName string, databases string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "default",
+			Annotations: map[string]string{DatabasesAnnotation: databases},
+		},
+		Spec: corev1.PodSpec{
+			NodeName:       nodeName,
+			ReadinessGates: []corev1.PodReadinessGate{{ConditionType: DatabaseAccessReadinessGate}},
+		},
+	}
+}
+
+func TestPodReadinessGate(t *testing.T) {
+	database := newTestDatabase(nil)
+	pod := newTestPod("app", "node-1", "db")
+	orphan := newTestPod("orphan", "node-1", "db, missing")
+	r, ovhApi := newTestReconciler(t, database, newTestNode("node-1", "10.0.0.1", nil), pod, orphan)
+	podReconciler := &PodReadinessReconciler{Client: r.Client}
+	expectCondition := func(pod *corev1.Pod, status corev1.ConditionStatus, reason string) {
+		t.Helper()
+		if _, err := podReconciler.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(pod)}); err != nil {
+			t.Fatalf("reconcile failed: %v", err)
+		}
+		got := &corev1.Pod{}
+		if err := r.Get(context.Background(), client.ObjectKeyFromObject(pod), got); err != nil {
+			t.Fatal(err)
+		}
+		for _, condition := range got.Status.Conditions {
+			if condition.Type == DatabaseAccessReadinessGate {
+				if condition.Status != status || condition.Reason != reason {
+					t.Errorf("unexpected condition of %s: %+v", pod.Name, condition)
+				}
+				return
+			}
+		}
+		t.Errorf("condition of %s not set", pod.Name)
+	}
+
+	// the node is not authorized until its ip is active
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	expectCondition(pod, corev1.ConditionFalse, reasonAccessPending)
+
+	cluster, _ := ovhApi.Service(testProjectId, testServiceId)
+	cluster.IpStatus = map[string]string{"10.0.0.1/32": IpStateReady}
+	ovhApi.AddService(testProjectId, cluster)
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	expectCondition(pod, corev1.ConditionTrue, reasonAccessGranted)
+	expectCondition(orphan, corev1.ConditionFalse, reasonDatabaseNotFound)
+
+	if reqs := podReconciler.podsForDatabase(context.Background(), database); len(reqs) != 2 {
+		t.Errorf("expected the 2 pods to be requeued, got %+v", reqs)
+	}
+
+	// the access is kept while the ip is in the ip restrictions, whatever its state and the result of the sync
+	cluster.IpStatus = map[string]string{"10.0.0.1/32": "UPDATING"}
+	ovhApi.AddService(testProjectId, cluster)
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	ovhApi.InjectError(FakeGetCluster, &ovh.APIError{Code: http.StatusInternalServerError, Message: "internal error"})
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	expectCondition(pod, corev1.ConditionTrue, reasonAccessGranted)
+
+	// and lost once the ip is removed
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(database), database); err != nil {
+		t.Fatal(err)
+	}
+	database.Spec.LabelSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"nodepool": "other"}}
+	if err := r.Update(context.Background(), database); err != nil {
+		t.Fatal(err)
+	}
+	if err := reconcileDatabase(t, r, database); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	expectCondition(pod, corev1.ConditionFalse, reasonAccessPending)
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/ovh/public-cloud-databases-operator/api/v1alpha1"
+)
+
+const (
+	DefaultMinNodes = 1
+	// DefaultMaxRemovalPercent disables the guard on the removals by default, as the entries of the replaced
+	// nodes are removals: replacing the single node of a pool removes all its entries
+	DefaultMaxRemovalPercent = 0
+
+	// SafetyGuardsOverrideAnnotation lets the next sync of the Database bypass the safety guards
+	// when set to "true", it is removed once the sync succeeded
+	SafetyGuardsOverrideAnnotation = "cloud.ovh.net/override-safety-guards"
+)
+
+// Reasons of the Blocked condition
+const (
+	reasonTooFewNodes     = "TooFewNodes"
+	reasonTooManyRemovals = "TooManyRemovals"
+	reasonNotBlocked      = "SafetyGuardsPassed"
+)
+
+// SafetyGuardsConfig is the operator wide configuration of the safety guards, each field can be
+// overridden by the spec of the crd. A zero value disables the guard.
+type SafetyGuardsConfig struct {
+	MinNodes          int
+	MaxRemovalPercent int
+}
+
+// safetyGuardError is returned when a safety guard blocks the sync of the crd
+type safetyGuardError struct {
+	reason  string
+	message string
+}
+
+func (e *safetyGuardError) Error() string {
+	return fmt.Sprintf("blocked by safety guard: %s, set the %s=true annotation to override", e.message, SafetyGuardsOverrideAnnotation)
+}
+
+// safetyGuards merges the safety guards of the crd with the operator defaults
+func (r *DatabaseReconciler) safetyGuards(crd v1alpha1.Database) SafetyGuardsConfig {
+	config := r.SafetyGuards
+	spec := crd.Spec.SafetyGuards
+	if spec == nil {
+		return config
+	}
+	if spec.MinNodes != nil {
+		config.MinNodes = int(*spec.MinNodes)
+	}
+	if spec.MaxRemovalPercent != nil {
+		config.MaxRemovalPercent = int(*spec.MaxRemovalPercent)
+	}
+	return config
+}
+
+// checkNodes blocks the sync when fewer nodes than expected are selected, which usually
+// means a mistyped label selector or an empty node cache
+func (c SafetyGuardsConfig) checkNodes(crd v1alpha1.Database, count int) error {
+	if count >= c.MinNodes || safetyGuardsOverridden(crd) {
+		return nil
+	}
+	return &safetyGuardError{
+		reason:  reasonTooFewNodes,
+		message: fmt.Sprintf("%d nodes selected, at least %d expected", count, c.MinNodes),
+	}
+}
+
+// checkRemovals blocks the update of the service when it removes too many of the ips authorized by the
+// operator of the cluster. The entries replaced by another one with the same ip are not removals.
+func (c SafetyGuardsConfig) checkRemovals(crd v1alpha1.Database, cluster string, serviceId string, current []IpRestriction, diff IpRestrictionsDiff) error {
+	if c.MaxRemovalPercent == 0 || safetyGuardsOverridden(crd) {
+		return nil
+	}
+	added := make(map[string]struct{}, len(diff.Added))
+	for _, ip := range diff.Added {
+		added[ip.IP] = struct{}{}
+	}
+	removed := 0
+	for _, ip := range diff.Removed {
+		if _, ok := added[ip.IP]; !ok {
+			removed++
+		}
+	}
+	managed := countManaged(current, cluster)
+	if removed == 0 || removed*100 <= managed*c.MaxRemovalPercent {
+		return nil
+	}
+	return &safetyGuardError{
+		reason: reasonTooManyRemovals,
+		message: fmt.Sprintf("service %s: removing %d of the %d ips authorized by the operator exceeds %d%%",
+			serviceId, removed, managed, c.MaxRemovalPercent),
+	}
+}
+
+// countManaged counts the entries of the operator of the cluster, including the ones created before the cluster name was set
+func countManaged(ips []IpRestriction, cluster string) int {
+	count := 0
+	for _, ip := range ips {
+		if ipCluster, managed := IpRestrictionCluster(ip); managed && (ipCluster == cluster || ipCluster == "") {
+			count++
+		}
+	}
+	return count
+}
+
+func safetyGuardsOverridden(crd v1alpha1.Database) bool {
+	return crd.Annotations[SafetyGuardsOverrideAnnotation] == "true"
+}
+
+// clearSafetyGuardsOverride removes the override annotation once used, so the guards apply again to the next syncs
+func (r *DatabaseReconciler) clearSafetyGuardsOverride(ctx context.Context, crd *v1alpha1.Database) error {
+	if _, ok := crd.Annotations[SafetyGuardsOverrideAnnotation]; !ok {
+		return nil
+	}
+	log.FromContext(ctx).Info("removing the safety guards override")
+	patch := client.MergeFrom(crd.DeepCopy())
+	delete(crd.Annotations, SafetyGuardsOverrideAnnotation)
+	return r.Patch(ctx, crd, patch)
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ovh/public-cloud-databases-operator/api/v1alpha1"
+)
+
+// serviceOwners are the other Databases targeting a service, along with the ips they want on it,
+// as reported in their status. The desired ip restrictions of the service are the union of the
+// ones of all its Databases. The entries of the operators of other clusters are left untouched.
+type serviceOwners struct {
+	cluster string
+	crd     v1alpha1.Database
+	others  []v1alpha1.Database
+	local   []v1alpha1.Database
+	wanted  map[string]struct{}
+}
+
+// serviceOwners returns the owners of the service other than the crd, the Databases being deleted excluded.
+// The entries of the Databases in dry run are left untouched, but the ips they plan are not wanted.
+func (r *DatabaseReconciler) serviceOwners(ctx context.Context, crd v1alpha1.Database, projectId string, serviceId string) (*serviceOwners, error) {
+	databases := v1alpha1.DatabaseList{}
+	if err := r.List(ctx, &databases); err != nil {
+		return nil, fmt.Errorf("failed to list databases: %w", err)
+	}
+
+	owners := &serviceOwners{cluster: r.ClusterName, crd: crd, local: databases.Items, wanted: map[string]struct{}{}}
+	for _, other := range databases.Items {
+		if other.UID == crd.UID || !other.DeletionTimestamp.IsZero() || !targetsService(other, projectId, serviceId) {
+			continue
+		}
+		owners.others = append(owners.others, other)
+		if r.dryRun(other) {
+			continue
+		}
+		for _, service := range other.Status.Services {
+			if service.ServiceId != serviceId {
+				continue
+			}
+			for _, ip := range service.AuthorizedIps {
+				owners.wanted[ip] = struct{}{}
+			}
+		}
+	}
+	return owners, nil
+}
+
+// targetsService checks if the service is one of the services of the crd
+func targetsService(crd v1alpha1.Database, projectId string, serviceId string) bool {
+	return crd.Spec.ProjectId == projectId && (crd.Spec.ServiceId == "" || crd.Spec.ServiceId == serviceId)
+}
+
+// wantedByOthers checks if another Database wants the ip on the service
+func (o *serviceOwners) wantedByOthers(ip string) bool {
+	_, ok := o.wanted[ip]
+	return ok
+}
+
+// ownedByOther checks if the entry was created by another Database, which manages it
+func (o *serviceOwners) ownedByOther(ip IpRestriction) bool {
+	for _, other := range o.others {
+		if IsIpRestrictionOwnedBy(ip, other) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocal checks if the entry was authorized by the operator of the cluster. The entries without
+// cluster name, created before it was set, are migrated when they belong to a Database of the cluster.
+func (o *serviceOwners) isLocal(ip IpRestriction) bool {
+	cluster, managed := IpRestrictionCluster(ip)
+	if !managed {
+		return false
+	}
+	if cluster == o.cluster {
+		return true
+	}
+	if cluster != "" {
+		return false
+	}
+	for _, crd := range o.local {
+		if IsIpRestrictionOwnedBy(ip, crd) {
+			return true
+		}
+	}
+	return false
+}
+
+// unmanaged returns the entries not managed by the operator of the cluster: the manual ones and the ones of other clusters
+func (o *serviceOwners) unmanaged(ips []IpRestriction) []IpRestriction {
+	unmanaged := []IpRestriction{}
+	for _, ip := range ips {
+		if !o.isLocal(ip) {
+			unmanaged = append(unmanaged, ip)
+		}
+	}
+	return unmanaged
+}
+
+// keep checks if an entry of the service, other than the desired ones of the crd, must be kept:
+// the manual entries and the ones of the other clusters and Databases are left untouched, the
+// entries of the crd and of the deleted Databases are only kept while another Database wants them
+func (o *serviceOwners) keep(ip IpRestriction) bool {
+	if !o.isLocal(ip) || o.ownedByOther(ip) {
+		return true
+	}
+	return o.wantedByOthers(ip.IP)
+}
+
+// merge returns the ip restrictions of the service once the desired ones of the crd are applied.
+// A desired ip already authorized by another entry is not added twice.
+func (o *serviceOwners) merge(current []IpRestriction, desired []IpRestriction) []IpRestriction {
+	desiredSet := make(map[IpRestriction]struct{}, len(desired))
+	for _, ip := range desired {
+		desiredSet[ip] = struct{}{}
+	}
+
+	kept := []IpRestriction{}
+	covered := map[string]struct{}{}
+	for _, ip := range current {
+		if _, ok := desiredSet[ip]; ok {
+			continue
+		}
+		if o.keep(ip) {
+			kept = append(kept, ip)
+			covered[ip.IP] = struct{}{}
+		}
+	}
+
+	newIPs := make([]IpRestriction, 0, len(desired)+len(kept))
+	for _, ip := range desired {
+		if _, ok := covered[ip.IP]; ok {
+			continue
+		}
+		covered[ip.IP] = struct{}{}
+		newIPs = append(newIPs, ip)
+	}
+	return append(newIPs, kept...)
+}
+
+// revoke returns the ip restrictions of the service once the entries of the crd are removed
+func (o *serviceOwners) revoke(current []IpRestriction) []IpRestriction {
+	newIPs := make([]IpRestriction, 0, len(current))
+	for _, ip := range current {
+		if !IsIpRestrictionOwnedBy(ip, o.crd) || o.wantedByOthers(ip.IP) {
+			newIPs = append(newIPs, ip)
+		}
+	}
+	return newIPs
+}
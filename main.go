@@ -17,8 +17,10 @@ limitations under the License.
 package main
 
 import (
+	"errors"
 	"flag"
 	"os"
+	"strings"
 	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
@@ -27,6 +29,7 @@ import (
 
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/cache"
@@ -35,7 +38,6 @@ import (
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
-	"github.com/ovh/go-ovh/ovh"
 	cloudv1alpha1 "github.com/ovh/public-cloud-databases-operator/api/v1alpha1"
 	"github.com/ovh/public-cloud-databases-operator/controllers"
 	//+kubebuilder:scaffold:imports
@@ -57,11 +59,72 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var egressDiscovery controllers.EgressDiscoveryConfig
+	var egressStaticIps string
+	var egressProbeGroupLabels string
+	var credentialsDir string
+	var credentialsPollInterval time.Duration
+	var credentialsCheck controllers.CredentialsCheckConfig
+	var dryRun bool
+	var clusterName string
+	var safetyGuards controllers.SafetyGuardsConfig
+	var applyTimeout time.Duration
+	var nodeTaints controllers.NodeTaintsConfig
+	var podReadinessGate bool
+	var resyncInterval time.Duration
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&egressDiscovery.Mode, "egress-discovery", cloudv1alpha1.EgressDiscoveryEcho,
+		"The default egress IPs discovery mode of the public services, one of Echo, Probe, Static, Annotation or Disabled.")
+	flag.StringVar(&egressDiscovery.EchoURL, "egress-echo-url", controllers.DefaultEgressEchoURL,
+		"The URL answering with the caller IP, requested in Echo mode.")
+	flag.StringVar(&egressStaticIps, "egress-static-ips", "", "The comma separated list of egress IPs used in Static mode.")
+	flag.StringVar(&egressDiscovery.Annotation, "egress-annotation", controllers.DefaultEgressAnnotation,
+		"The annotation holding the egress IPs in Annotation mode.")
+	flag.DurationVar(&egressDiscovery.Timeout, "egress-timeout", controllers.DefaultEgressTimeout, "The timeout of the egress IPs discovery.")
+	probeNamespace := controllers.DefaultEgressProbeNamespace
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		probeNamespace = namespace
+	}
+	flag.StringVar(&egressDiscovery.ProbeNamespace, "egress-probe-namespace", probeNamespace,
+		"The namespace of the egress probe pods run in Probe mode, defaults to the namespace of the operator.")
+	flag.StringVar(&egressDiscovery.ProbeImage, "egress-probe-image", controllers.DefaultEgressProbeImage,
+		"The image of the egress probe pods, it must provide curl.")
+	flag.StringVar(&egressProbeGroupLabels, "egress-probe-group-labels", strings.Join(controllers.DefaultEgressProbeGroupLabels, ","),
+		"The comma separated node labels used to group the nodes sharing the same egress, one probe is run per group.")
+	flag.DurationVar(&egressDiscovery.ProbeTTL, "egress-probe-ttl", controllers.DefaultEgressProbeTTL, "The duration the result of an egress probe is cached.")
+	flag.StringVar(&credentialsDir, "credentials-dir", "",
+		"The directory holding the OVHcloud api credentials, one file per key. "+
+			"The credentials are reloaded when the files change. If not set, the credentials are read from the environment.")
+	flag.DurationVar(&credentialsPollInterval, "credentials-poll-interval", controllers.DefaultCredentialsPollInterval,
+		"The interval between two checks of the credentials directory.")
+	flag.DurationVar(&credentialsCheck.Interval, "credentials-check-interval", controllers.DefaultCredentialsCheckInterval,
+		"The interval between two checks of the access rules of the credentials.")
+	flag.DurationVar(&credentialsCheck.ExpirationWarning, "credentials-expiration-warning", controllers.DefaultCredentialsExpirationWarning,
+		"How long before the expiration of the credentials a warning is reported.")
+	flag.BoolVar(&dryRun, "dry-run", false,
+		"Only report the changes of the ip restrictions in the status and events of the Databases, without applying them.")
+	flag.IntVar(&safetyGuards.MinNodes, "min-nodes", controllers.DefaultMinNodes,
+		"The default minimum number of nodes selected by a Database for its services to be synced, 0 disables the guard.")
+	flag.IntVar(&safetyGuards.MaxRemovalPercent, "max-removal-percent", controllers.DefaultMaxRemovalPercent,
+		"The default maximum percentage of the IPs authorized by the operator on a service that may be removed at once, 0 disables the guard.")
+	flag.StringVar(&clusterName, "cluster-name", "",
+		"The name of the cluster, written in the descriptions of the authorized IPs so that the operators of several clusters "+
+			"sharing a service only manage their own entries.")
+	flag.DurationVar(&applyTimeout, "apply-timeout", controllers.DefaultApplyTimeout,
+		"How long after a change the services are polled until the ip restrictions are active, before reporting them as not applied.")
+	flag.StringVar(&nodeTaints.Mode, "node-taint-mode", "",
+		"Keep the workloads away from the selected nodes until they are authorized: add taints the nodes and removes the taint once "+
+			"their IPs are active on all the services, remove only removes the taint set by their node pool. Disabled when empty.")
+	flag.StringVar(&nodeTaints.Key, "node-taint-key", controllers.DefaultNodeTaintKey, "The key of the NoSchedule taint of the nodes not yet authorized.")
+	flag.DurationVar(&resyncInterval, "resync-interval", controllers.DefaultResyncInterval,
+		"The interval between two syncs of a Database without change, correcting the changes of the IP restrictions made outside of the operator.")
+	flag.BoolVar(&podReadinessGate, "pod-readiness-gate", false,
+		"Set the condition of the cloud.ovh.net/database-access readiness gate of the pods declaring it, once their node is authorized "+
+			"on the Databases listed in their cloud.ovh.net/databases annotation.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -70,6 +133,31 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	if errs := validation.IsDNS1123Label(clusterName); clusterName != "" && len(errs) > 0 {
+		setupLog.Error(errors.New(strings.Join(errs, ", ")), "invalid cluster name", "cluster", clusterName)
+		os.Exit(1)
+	}
+	switch egressDiscovery.Mode {
+	case cloudv1alpha1.EgressDiscoveryEcho, cloudv1alpha1.EgressDiscoveryProbe, cloudv1alpha1.EgressDiscoveryStatic,
+		cloudv1alpha1.EgressDiscoveryAnnotation, cloudv1alpha1.EgressDiscoveryDisabled:
+	default:
+		setupLog.Error(errors.New("expected Echo, Probe, Static, Annotation or Disabled"), "invalid egress discovery mode", "mode", egressDiscovery.Mode)
+		os.Exit(1)
+	}
+	switch nodeTaints.Mode {
+	case "", controllers.NodeTaintModeAdd, controllers.NodeTaintModeRemove:
+	default:
+		setupLog.Error(errors.New("expected add or remove"), "invalid node taint mode", "mode", nodeTaints.Mode)
+		os.Exit(1)
+	}
+
+	if egressStaticIps != "" {
+		egressDiscovery.StaticIps = strings.Split(egressStaticIps, ",")
+	}
+	if egressProbeGroupLabels != "" {
+		egressDiscovery.ProbeGroupLabels = strings.Split(egressProbeGroupLabels, ",")
+	}
+
 	syncPeriod := 30 * time.Minute
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Cache:                  cache.Options{SyncPeriod: &syncPeriod},
@@ -97,30 +185,75 @@ func main() {
 	}
 
 	//secrets management
-	region := os.Getenv("REGION")
-	applicationKey := os.Getenv("APPLICATION_KEY")
-	applicationSecret := os.Getenv("APPLICATION_SECRET")
-	consumerKey := os.Getenv("CONSUMER_KEY")
-
-	ovhClient, err := ovh.NewClient(
-		region,
-		applicationKey,
-		applicationSecret,
-		consumerKey,
-	)
+	credentials := controllers.OvhCredentials{
+		Region:            os.Getenv("REGION"),
+		ApplicationKey:    os.Getenv("APPLICATION_KEY"),
+		ApplicationSecret: os.Getenv("APPLICATION_SECRET"),
+		ConsumerKey:       os.Getenv("CONSUMER_KEY"),
+		ClientId:          os.Getenv("CLIENT_ID"),
+		ClientSecret:      os.Getenv("CLIENT_SECRET"),
+	}
+	if credentialsDir != "" {
+		credentials, err = controllers.LoadCredentialsDir(credentialsDir)
+		if err != nil {
+			setupLog.Error(err, "unable to read credentials", "dir", credentialsDir)
+			os.Exit(1)
+		}
+	}
+
+	api, err := controllers.NewOvhApi(credentials)
 	if err != nil {
 		setupLog.Error(err, "unable to instantiate ovh api client")
 		os.Exit(1)
 	}
+	setupLog.Info("ovh api client ready", "authMode", credentials.AuthMode())
+	controllers.SetOperatorAuthModeMetric(credentials.AuthMode())
+	ovhClient := controllers.NewSwappableOvhApi(api)
 
-	if err = (&controllers.DatabaseReconciler{
-		Client:    mgr.GetClient(),
-		Scheme:    mgr.GetScheme(),
-		OvhClient: ovhClient,
-	}).SetupWithManager(mgr); err != nil {
+	reconciler := &controllers.DatabaseReconciler{
+		Client:           mgr.GetClient(),
+		Scheme:           mgr.GetScheme(),
+		Recorder:         mgr.GetEventRecorderFor("database-controller"),
+		APIReader:        mgr.GetAPIReader(),
+		OvhClient:        ovhClient,
+		EgressDiscovery:  egressDiscovery,
+		CredentialsCheck: credentialsCheck,
+		ClusterName:      clusterName,
+		SafetyGuards:     safetyGuards,
+		DryRun:           dryRun,
+		ApplyTimeout:     applyTimeout,
+		NodeTaints:       nodeTaints,
+		ResyncInterval:   resyncInterval,
+	}
+	if dryRun {
+		setupLog.Info("dry run, the ip restrictions of the services will not be modified")
+	}
+	if err = reconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Database")
 		os.Exit(1)
 	}
+	if podReadinessGate {
+		podReconciler := &controllers.PodReadinessReconciler{
+			Client:      mgr.GetClient(),
+			ClusterName: clusterName,
+		}
+		if err = podReconciler.SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "Pod")
+			os.Exit(1)
+		}
+	}
+	if credentialsDir != "" {
+		watcher := controllers.NewCredentialsWatcher(credentialsDir, credentialsPollInterval, ovhClient, credentials, reconciler)
+		if err := mgr.Add(watcher); err != nil {
+			setupLog.Error(err, "unable to set up credentials watcher")
+			os.Exit(1)
+		}
+	}
+	credentialsChecker := controllers.NewCredentialsChecker(ovhClient, reconciler)
+	if err := mgr.Add(credentialsChecker); err != nil {
+		setupLog.Error(err, "unable to set up credentials checker")
+		os.Exit(1)
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -131,6 +264,10 @@ func main() {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
+	if err := mgr.AddReadyzCheck("credentials", credentialsChecker.Check); err != nil {
+		setupLog.Error(err, "unable to set up credentials ready check")
+		os.Exit(1)
+	}
 
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {